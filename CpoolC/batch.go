@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+)
+
+// Batch writes of one-way messages: a batch is written with writev in one syscall, and the coalescing mode merges
+// the messages of concurrent callers written within a flush window into one batch.
+var (
+	batch_benchmark    = flag.Int("batch-benchmark", 0, "Send this number of one-way messages with each write mode and print the throughput (0: disabled)")
+	batch_size         = flag.Int("batch-size", 16, "Messages per batch, and concurrent callers of the coalescing, in the batch benchmark")
+	coalesce_window    = flag.Duration("coalesce-window", 200*time.Microsecond, "Flush window of the write coalescing")
+	coalesce_max_bytes = flag.Int("coalesce-max-bytes", 64*1024, "Flush the coalesced messages when they reach this size")
+)
+
+// SendMultiple writes the messages on one connection of the pool, in one writev syscall on a TCP connection.
+func SendMultiple(pool *Pool, payloads [][]byte) error {
+	res, err := pool.Acquire(context.Background())
+	if err != nil {
+		return err
+	}
+
+	// WriteTo consumes the buffers, the payloads of the caller are kept
+	buffers := make(net.Buffers, len(payloads))
+	copy(buffers, payloads)
+	if _, err := buffers.WriteTo(res.Value()); err != nil {
+		res.Destroy(err)
+		return err
+	}
+	res.Release()
+	return nil
+}
+
+// sendOneByOne writes the messages on one connection of the pool, one write each.
+func sendOneByOne(pool *Pool, payloads [][]byte) error {
+	res, err := pool.Acquire(context.Background())
+	if err != nil {
+		return err
+	}
+	for _, payload := range payloads {
+		if _, err := res.Value().Write(payload); err != nil {
+			res.Destroy(err)
+			return err
+		}
+	}
+	res.Release()
+	return nil
+}
+
+type coalescedWrite struct {
+	payload []byte
+	done    chan error
+}
+
+// Coalescer merges the messages sent concurrently into batches, flushed after the window
+// following the first message of the batch, or when the batch reaches max_bytes.
+type Coalescer struct {
+	pool      *Pool
+	window    time.Duration
+	max_bytes int
+
+	mux        sync.Mutex
+	pending    []*coalescedWrite
+	size       int
+	generation uint64 // of the pending batch, so a late timer does not flush the next batch
+
+	// counters, for the stats
+	flushes  uint64
+	messages uint64
+}
+
+func NewCoalescer(pool *Pool, window time.Duration, max_bytes int) *Coalescer {
+	return &Coalescer{pool: pool, window: window, max_bytes: max_bytes}
+}
+
+// Send adds the message to the pending batch, and returns when the batch is written.
+func (c *Coalescer) Send(payload []byte) error {
+	write := &coalescedWrite{payload: payload, done: make(chan error, 1)}
+
+	c.mux.Lock()
+	c.pending = append(c.pending, write)
+	c.size += len(payload)
+	if c.size >= c.max_bytes {
+		batch := c.take()
+		c.mux.Unlock()
+		c.flush(batch)
+	} else {
+		if len(c.pending) == 1 {
+			generation := c.generation
+			time.AfterFunc(c.window, func() { c.flushGeneration(generation) })
+		}
+		c.mux.Unlock()
+	}
+	return <-write.done
+}
+
+// take returns the pending batch and starts a new one, the caller holds the lock.
+func (c *Coalescer) take() []*coalescedWrite {
+	batch := c.pending
+	c.pending = nil
+	c.size = 0
+	c.generation++
+	return batch
+}
+
+func (c *Coalescer) flushGeneration(generation uint64) {
+	c.mux.Lock()
+	if generation != c.generation {
+		c.mux.Unlock()
+		return
+	}
+	batch := c.take()
+	c.mux.Unlock()
+	c.flush(batch)
+}
+
+func (c *Coalescer) flush(batch []*coalescedWrite) {
+	payloads := make([][]byte, len(batch))
+	for i, write := range batch {
+		payloads[i] = write.payload
+	}
+	err := SendMultiple(c.pool, payloads)
+	atomic.AddUint64(&c.flushes, 1)
+	atomic.AddUint64(&c.messages, uint64(len(batch)))
+	for _, write := range batch {
+		write.done <- err
+	}
+}
+
+// Stats returns the number of batches written, and of the messages in them.
+func (c *Coalescer) Stats() (flushes uint64, messages uint64) {
+	return atomic.LoadUint64(&c.flushes), atomic.LoadUint64(&c.messages)
+}
+
+// BatchBenchmark sends n one-way messages with each write mode: one write per message, one writev per batch,
+// and the coalescing of batch_size concurrent callers.
+func BatchBenchmark(pool *Pool, n int) error {
+	msg := diam.NewRequest(diam.Accounting, 0, nil)
+	msg.NewAVP(avp.SessionID, avp.Mbit, 0, datatype.UTF8String("test_send_Multiple_message")) // not answered by the test server
+	payload, err := msg.Serialize()
+	if err != nil {
+		return err
+	}
+	batch := make([][]byte, *batch_size)
+	for i := range batch {
+		batch[i] = payload
+	}
+
+	report := func(mode string, start time.Time, writes uint64) {
+		elapsed := time.Since(start)
+		fmt.Printf("%-12s %d messages in %s, %.0f messages/s, %d writes\n", mode, n, elapsed, float64(n)/elapsed.Seconds(), writes)
+	}
+
+	start := time.Now()
+	for sent := 0; sent < n; sent += len(batch) {
+		if err := sendOneByOne(pool, batchOf(batch, n-sent)); err != nil {
+			return err
+		}
+	}
+	report("one by one:", start, uint64(n))
+
+	start = time.Now()
+	var writes uint64
+	for sent := 0; sent < n; sent += len(batch) {
+		if err := SendMultiple(pool, batchOf(batch, n-sent)); err != nil {
+			return err
+		}
+		writes++
+	}
+	report("writev:", start, writes)
+
+	coalescer := NewCoalescer(pool, *coalesce_window, *coalesce_max_bytes)
+	var wg sync.WaitGroup
+	var failed uint64
+	start = time.Now()
+	for caller := 0; caller < *batch_size; caller++ {
+		wg.Add(1)
+		go func(caller int) {
+			defer wg.Done()
+			for i := caller; i < n; i += *batch_size {
+				if err := coalescer.Send(payload); err != nil {
+					atomic.AddUint64(&failed, 1)
+				}
+			}
+		}(caller)
+	}
+	wg.Wait()
+	flushes, messages := coalescer.Stats()
+	report("coalesced:", start, flushes)
+	if flushes > 0 {
+		fmt.Printf("%-12s %.1f messages per write\n", "", float64(messages)/float64(flushes))
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d coalesced messages failed", failed)
+	}
+	return nil
+}
+
+// batchOf returns the batch, or its first remaining messages.
+func batchOf(batch [][]byte, remaining int) [][]byte {
+	if remaining < len(batch) {
+		return batch[:remaining]
+	}
+	return batch
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+)
+
+var (
+	breaker_failures  = flag.Int("breaker-failures", 5, "Consecutive failures opening the circuit breaker of a server (0: no breaker)")
+	breaker_open_time = flag.Duration("breaker-open-time", 10*time.Second, "Time the circuit stays open before letting probes through")
+	breaker_probes    = flag.Int("breaker-probes", 1, "Requests let through by a half-open circuit")
+)
+
+// ErrCircuitOpen fails the requests to a server while its circuit breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+type CircuitState int
+
+const (
+	CircuitClosed   CircuitState = iota // requests pass, the consecutive failures are counted
+	CircuitOpen                         // requests and dials fail fast
+	CircuitHalfOpen                     // a limited number of probes pass, the first result closes or opens the circuit
+)
+
+func (state CircuitState) String() string {
+	switch state {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// CircuitBreaker of an endpoint, fed by the dial errors, the destroyed connections and the transient Result-Codes.
+// A nil breaker lets everything through.
+type CircuitBreaker struct {
+	endpoint  string
+	failures  int           // consecutive failures opening the circuit
+	open_time time.Duration // before the half-open state
+	probes    int           // requests and dials let through by the half-open state, again after open_time without result
+
+	mux         sync.Mutex
+	state       CircuitState
+	consecutive int
+	changed     time.Time // of the state
+	probes_left int
+	dials_left  int
+	opened      uint64 // times the circuit opened
+}
+
+func NewCircuitBreaker(endpoint string, failures int, open_time time.Duration, probes int) *CircuitBreaker {
+	if failures <= 0 {
+		return nil
+	}
+	if probes < 1 {
+		probes = 1
+	}
+	return &CircuitBreaker{endpoint: endpoint, failures: failures, open_time: open_time, probes: probes, changed: time.Now()}
+}
+
+// setState changes the state. The caller holds the lock.
+func (b *CircuitBreaker) setState(state CircuitState) {
+	if state == b.state {
+		return
+	}
+	log.Printf("Circuit breaker %s: %s -> %s\n", b.endpoint, b.state, state)
+	b.state, b.changed = state, time.Now()
+	b.consecutive = 0
+	switch state {
+	case CircuitOpen:
+		b.opened++
+	case CircuitHalfOpen:
+		b.probes_left, b.dials_left = b.probes, b.probes
+	}
+}
+
+// update moves an open circuit to half-open after open_time, and grants the probes and dials again to a half-open circuit
+// without result for open_time. The caller holds the lock.
+func (b *CircuitBreaker) update() {
+	if time.Since(b.changed) < b.open_time {
+		return
+	}
+	switch b.state {
+	case CircuitOpen:
+		b.setState(CircuitHalfOpen)
+	case CircuitHalfOpen:
+		if b.probes_left == 0 || b.dials_left == 0 {
+			b.changed, b.probes_left, b.dials_left = time.Now(), b.probes, b.probes
+		}
+	}
+}
+
+// Allow returns ErrCircuitOpen if the request must fail fast.
+func (b *CircuitBreaker) Allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.update()
+	switch b.state {
+	case CircuitOpen:
+		return ErrCircuitOpen
+	case CircuitHalfOpen:
+		if b.probes_left == 0 {
+			return ErrCircuitOpen
+		}
+		b.probes_left--
+	}
+	return nil
+}
+
+// AllowDial returns ErrCircuitOpen if the dial must fail fast: the half-open state lets as many dials through as probes.
+func (b *CircuitBreaker) AllowDial() error {
+	if b == nil {
+		return nil
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.update()
+	switch b.state {
+	case CircuitOpen:
+		return ErrCircuitOpen
+	case CircuitHalfOpen:
+		if b.dials_left == 0 {
+			return ErrCircuitOpen
+		}
+		b.dials_left--
+	}
+	return nil
+}
+
+func (b *CircuitBreaker) Success() {
+	if b == nil {
+		return
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	switch b.state {
+	case CircuitClosed:
+		b.consecutive = 0
+	case CircuitHalfOpen:
+		b.setState(CircuitClosed)
+	}
+}
+
+func (b *CircuitBreaker) Failure() {
+	if b == nil {
+		return
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	switch b.state {
+	case CircuitClosed:
+		b.consecutive++
+		if b.consecutive >= b.failures {
+			b.setState(CircuitOpen)
+		}
+	case CircuitHalfOpen:
+		b.setState(CircuitOpen)
+	}
+}
+
+// State returns the state and the times the circuit opened.
+func (b *CircuitBreaker) State() (CircuitState, uint64) {
+	if b == nil {
+		return CircuitClosed, 0
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.update()
+	return b.state, b.opened
+}
+
+// transientResult reports whether the Result-Code of the answer tells the server can not serve now.
+func transientResult(answer *diam.Message) bool {
+	result_code, err := answer.FindAVP(avp.ResultCode, 0)
+	if err != nil {
+		return false
+	}
+	code, ok := result_code.Data.(datatype.Unsigned32)
+	return ok && (code == diam.UnableToDeliver || code == diam.TooBusy)
+}
+
+// SetCircuitBreaker sets the breaker of the pool, before its first acquire.
+func (p *Pool) SetCircuitBreaker(breaker *CircuitBreaker) {
+	p.breaker = breaker
+}
+
+// CheckAnswer feeds the breaker with the Result-Code of the answer received on the connection.
+func (r *Resource) CheckAnswer(answer *diam.Message) {
+	if r.failed || r.pool.breaker == nil {
+		return
+	}
+	if transientResult(answer) {
+		r.failed = true
+		r.pool.breaker.Failure()
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// expire ends the open time of the current state of the breaker.
+func (b *CircuitBreaker) expire() {
+	b.mux.Lock()
+	b.changed = b.changed.Add(-b.open_time)
+	b.mux.Unlock()
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	type step struct {
+		action string // failure, success, expire, allow, dial
+		err    error  // of allow and dial
+		state  CircuitState
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"opens after the consecutive failures", []step{
+			{action: "failure", state: CircuitClosed},
+			{action: "success", state: CircuitClosed},
+			{action: "failure", state: CircuitClosed},
+			{action: "failure", state: CircuitOpen},
+			{action: "allow", err: ErrCircuitOpen, state: CircuitOpen},
+			{action: "dial", err: ErrCircuitOpen, state: CircuitOpen},
+		}},
+		{"half-open probe closes", []step{
+			{action: "failure"}, {action: "failure", state: CircuitOpen},
+			{action: "expire", state: CircuitHalfOpen},
+			{action: "allow", state: CircuitHalfOpen},
+			{action: "success", state: CircuitClosed},
+			{action: "allow", state: CircuitClosed},
+		}},
+		{"half-open probe opens", []step{
+			{action: "failure"}, {action: "failure", state: CircuitOpen},
+			{action: "expire", state: CircuitHalfOpen},
+			{action: "allow", state: CircuitHalfOpen},
+			{action: "failure", state: CircuitOpen},
+			{action: "allow", err: ErrCircuitOpen, state: CircuitOpen},
+		}},
+		{"probe budget of the requests", []step{
+			{action: "failure"}, {action: "failure", state: CircuitOpen},
+			{action: "expire", state: CircuitHalfOpen},
+			{action: "allow", state: CircuitHalfOpen},
+			{action: "allow", state: CircuitHalfOpen},
+			{action: "allow", err: ErrCircuitOpen, state: CircuitHalfOpen},
+			{action: "expire", state: CircuitHalfOpen},
+			{action: "allow", state: CircuitHalfOpen},
+		}},
+		{"probe budget of the dials", []step{
+			{action: "failure"}, {action: "failure", state: CircuitOpen},
+			{action: "expire", state: CircuitHalfOpen},
+			{action: "dial", state: CircuitHalfOpen},
+			{action: "dial", state: CircuitHalfOpen},
+			{action: "dial", err: ErrCircuitOpen, state: CircuitHalfOpen},
+			{action: "allow", state: CircuitHalfOpen},
+			{action: "expire", state: CircuitHalfOpen},
+			{action: "dial", state: CircuitHalfOpen},
+			{action: "success", state: CircuitClosed},
+			{action: "dial", state: CircuitClosed},
+			{action: "dial", state: CircuitClosed},
+			{action: "dial", state: CircuitClosed},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := NewCircuitBreaker("test", 2, time.Hour, 2)
+			for i, step := range test.steps {
+				var err error
+				switch step.action {
+				case "failure":
+					b.Failure()
+				case "success":
+					b.Success()
+				case "expire":
+					b.expire()
+				case "allow":
+					err = b.Allow()
+				case "dial":
+					err = b.AllowDial()
+				}
+				if !errors.Is(err, step.err) {
+					t.Fatalf("step %d %s: error %v, want %v", i+1, step.action, err, step.err)
+				}
+				if state, _ := b.State(); state != step.state {
+					t.Fatalf("step %d %s: state %s, want %s", i+1, step.action, state, step.state)
+				}
+			}
+		})
+	}
+}
+
+func TestNilCircuitBreaker(t *testing.T) {
+	b := NewCircuitBreaker("test", 0, time.Hour, 1)
+	if b != nil {
+		t.Fatal("breaker without failures")
+	}
+	b.Failure()
+	if b.Allow() != nil || b.AllowDial() != nil {
+		t.Error("nil breaker failed")
+	}
+	if state, opened := b.State(); state != CircuitClosed || opened != 0 {
+		t.Errorf("state %s, opened %d", state, opened)
+	}
+}
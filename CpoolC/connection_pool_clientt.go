@@ -3,24 +3,32 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net"
 	"sync"
 	"time"
 
+	"common/inbound"
+	"common/vendordict"
+
 	"github.com/fiorix/go-diameter/v4/diam"
 	"github.com/fiorix/go-diameter/v4/diam/avp"
 	"github.com/fiorix/go-diameter/v4/diam/datatype"
-	"github.com/fiorix/go-diameter/v4/diam/dict"
-	"github.com/jackc/puddle/v2"
 )
 
-type myKeyType int
+func main() {
 
-const addr_key myKeyType = 1
+	flag.Parse()
+	if *telemetry_address != "" && *telemetry_interval <= 0 {
+		log.Fatalf("-telemetry-interval %s is not positive\n", *telemetry_interval)
+	}
 
-func main() {
+	// AVPs of the test server in its answers
+	if err := vendordict.Load(); err != nil {
+		log.Fatal(err)
+	}
 
 	const (
 		minPoolSize                  uint  = 2
@@ -28,39 +36,119 @@ func main() {
 		reconnect_interval_in_second       = 5
 	)
 
-	server_address, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:8080")
+	server_address, err := net.ResolveTCPAddr("tcp", *server)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dialer, err := NewDialer(*server)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	// Create a TCP connection pool
 	// Max TCP connection of pool is maxPoolSize
 
-	pool, err := puddle.NewPool(
-		&puddle.Config[net.Conn]{
-			Constructor: CreateNewConnection,
-			Destructor:  CloseConnection,
-			MaxSize:     maxPoolSize,
-		},
-	)
+	// Optional: hooks on the lifecycle events of the connections
+	var hooks *Hooks
+	if *pool_events {
+		hooks = LogHooks(*server)
+	}
+
+	pool, err := NewPool(dialer, maxPoolSize, hooks)
 
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	// Optional: fail fast while the server is down
+	pool.SetCircuitBreaker(NewCircuitBreaker(*server, *breaker_failures, *breaker_open_time, *breaker_probes))
+
+	// Optional: connections reserved to the higher priority classes
+	reserved, err := ParseReserved(*priority_reserved)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := pool.ReserveClasses(reserved); err != nil {
+		log.Fatal(err)
+	}
+
+	// Optional: weights and max connections of the tenants sharing the pool
+	tenants, err := ParseTenants(*tenants_config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := pool.SetTenants(tenants); err != nil {
+		log.Fatal(err)
+	}
+
 	// Optional:   Init minPoolSize TCP connection for the pool
-	err = InitConnection(pool, minPoolSize, server_address)
+	err = InitConnection(pool, minPoolSize)
 	if err != nil {
 		pool.Close()
 		log.Fatal(err)
 	}
 
-	go ReconnectForever(pool, maxPoolSize, server_address, reconnect_interval_in_second)
+	// Answer the requests sent by the server on the connections of the pool
+	inbound.Handle(diam.ReAuth, inbound.AnswerSuccess)
+	inbound.Handle(diam.AbortSession, inbound.AnswerSuccess)
+
+	go ReconnectForever(pool, maxPoolSize, reconnect_interval_in_second)
+
+	// Optional: print the stats of the pool
+	if *stats_interval > 0 {
+		snapshots, _, err := pool.Subscribe(*stats_interval)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go PrintStats(*server, snapshots)
+	}
+
+	// Optional: publish the stats of the pools to the telemetry
+	if *telemetry_address != "" {
+		if err := PublishStats(*server, pool); err != nil {
+			log.Fatal(err)
+		}
+		go ServeTelemetry(*telemetry_address)
+	}
+
+	// pools to the hosts of the redirects
+	redirect_pools.max_size = maxPoolSize
+	redirect_pools.reserved = reserved
+	redirect_pools.tenants = tenants
+	defer redirect_pools.Close()
+
+	// Optional: replay the traffic recorded by the server instead of the test tasks
+	if *replay_file != "" {
+		if err := Replay(pool, *replay_file, *replay_speed); err != nil {
+			log.Println(err)
+		}
+		PrintPoolState(pool)
+		pool.Close()
+		return
+	}
+
+	// Optional: compare the write modes of the one-way messages instead of the test tasks
+	if *batch_benchmark > 0 {
+		if err := BatchBenchmark(pool, *batch_benchmark); err != nil {
+			log.Println(err)
+		}
+		PrintPoolState(pool)
+		pool.Close()
+		return
+	}
 
 	// simulating send 100 packages via pool
 
 	var wg sync.WaitGroup
 	wg.Add(101)
 
+	// the tasks are shared round robin by the configured tenants
 	for i := 1; i < 101; i++ {
-		go RunTask(pool, fmt.Sprintf("task_%d", i), server_address, &wg)
+		tenant := ""
+		if len(tenants) > 0 {
+			tenant = tenants[i%len(tenants)].Name
+		}
+		go RunTask(pool, tenant, fmt.Sprintf("task_%d", i), server_address, &wg)
 		time.Sleep(50 * time.Millisecond)
 	}
 	// Wait for all task is finish
@@ -68,6 +156,7 @@ func main() {
 
 	// optional
 	PrintPoolState(pool)
+	PrintLatencies()
 
 	pool.Close()
 }
@@ -76,25 +165,12 @@ func main() {
 
 // #####################################################
 
-func CreateNewConnection(ctx context.Context) (net.Conn, error) {
-	server_address := ctx.Value(addr_key).(*net.TCPAddr)
-	connection, err := net.DialTCP("tcp", nil, server_address)
-	if err == nil {
-		connection.SetKeepAlive(true)
-		connection.SetKeepAlivePeriod(30 * time.Second)
-	}
-	return connection, err
-}
-
 func CloseConnection(value net.Conn) { value.Close() }
 
-func InitConnection(pool *puddle.Pool[net.Conn], num_connection uint, server_address *net.TCPAddr) error {
+func InitConnection(pool *Pool, num_connection uint) error {
 
 	for i := 0; i < int(num_connection); i++ {
-		ctx := context.Background()
-		ctx = context.WithValue(ctx, addr_key, server_address)
-
-		err := pool.CreateResource(ctx)
+		err := pool.CreateResource(context.Background())
 		if err != nil {
 			return err
 		}
@@ -102,9 +178,7 @@ func InitConnection(pool *puddle.Pool[net.Conn], num_connection uint, server_add
 	return nil
 }
 
-func ReconnectForever(pool *puddle.Pool[net.Conn], maxPoolSize int32, server_address *net.TCPAddr, reconnect_interval_in_second time.Duration) {
-
-	one := make([]byte, 1)
+func ReconnectForever(pool *Pool, maxPoolSize int32, reconnect_interval_in_second time.Duration) {
 
 	timeout := 3 * time.Second
 
@@ -113,19 +187,15 @@ func ReconnectForever(pool *puddle.Pool[net.Conn], maxPoolSize int32, server_add
 		// If the pool have no one connection, it should be to reconnect.
 
 		if pool.Stat().TotalResources() == 0 {
-			InitConnection(pool, 1, server_address)
+			InitConnection(pool, 1)
 		}
 		// remove connections lost
 
-		for _, connection := range pool.AcquireAllIdle() {
-			connection.Value().(*net.TCPConn).SetReadDeadline(time.Now().Add(timeout))
-			_, err := connection.Value().Read(one)
+		// the server-initiated requests received on the idle connections are answered meanwhile
 
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				connection.Release()
-				continue
-			} else if err != nil {
-				connection.Destroy()
+		for _, connection := range pool.AcquireAllIdle() {
+			if err := inbound.CheckIdleConnection(connection.Value(), timeout); err != nil {
+				connection.HealthCheckFailed(err)
 				continue
 			}
 
@@ -142,43 +212,60 @@ func ReconnectForever(pool *puddle.Pool[net.Conn], maxPoolSize int32, server_add
 
 		// in test
 		time.Sleep(2*reconnect_interval_in_second ^ time.Second)
-		PrintPoolState(pool)
 	}
 }
 
-func RunTask(pool *puddle.Pool[net.Conn], message string, server_address *net.TCPAddr, wg *sync.WaitGroup) {
+func RunTask(pool *Pool, tenant string, message string, server_address *net.TCPAddr, wg *sync.WaitGroup) {
 	defer wg.Done()
 
-	ctx := context.Background()
-	ctx = context.WithValue(ctx, addr_key, server_address)
-
-	// Return a connection managed by pool
-	// If the pool has not idle connection and the total connection of the pool are less than maxPoolSize then Acquire method will create new connection .
-	res, err := pool.Acquire(ctx)
-	if err != nil {
-		log.Printf("ERROR Run task %s ", message)
-		log.Println(err)
-		return
-	}
-
-	res.Value().SetDeadline(time.Time{})
-
 	// encapsulation message
 	msg := diam.NewRequest(diam.Accounting, 0, nil)
 	sessionID := datatype.UTF8String(message)
 	msg.NewAVP(avp.SessionID, avp.Mbit, 0, sessionID)
+	if *doic_enabled {
+		msg.AddAVP(SupportedFeatures())
+	}
 
-	// Send message to server
-	_, err = msg.WriteTo(res.Value())
+	// send to the host of a cached redirect, and follow the redirects
+	target := redirects.Lookup(msg, server_address)
+	var res *Resource
+	var response *diam.Message
+	var latency Latency
+	for redirected := 0; ; redirected++ {
+		// the server of this hop reported an overload
+		if !overload.Admit(target.String()) {
+			log.Printf("Throttled task %s, server %s overloaded\n", message, target)
+			return
+		}
 
-	if err != nil {
-		log.Println(err)
-		res.Destroy()
-		return
-	}
+		target_pool := pool
+		if target.String() != server_address.String() {
+			var err error
+			if target_pool, err = redirect_pools.Get(target); err != nil {
+				log.Println(err)
+				return
+			}
+		}
 
-	// receive message from server
-	response, _ := diam.ReadMessage(res.Value(), dict.Default)
+		var err error
+		res, response, latency, err = sendRequest(target_pool, tenant, msg)
+		if err != nil {
+			log.Printf("ERROR Run task %s ", message)
+			log.Println(err)
+			return
+		}
+		overload.Update(target.String(), response)
+
+		host, ok := redirects.Follow(msg, response)
+		if !ok || redirected == *max_redirects {
+			break
+		}
+		res.Release()
+		log.Printf("Redirected task %s from %s to %s\n", message, target, host)
+		target = host
+	}
+	latencies.Add(latency)
+	log.Printf("Latency of task %s: %s\n", message, latency)
 
 	fmt.Println("\n____________________________________________________________")
 	fmt.Println(response.String())
@@ -196,12 +283,36 @@ func RunTask(pool *puddle.Pool[net.Conn], message string, server_address *net.TC
 	// res.ReleaseUnused()  // remove the connection
 }
 
-func PrintPoolState(pool *puddle.Pool[net.Conn]) {
-	js := make(map[string]int64)
-	js["AcquiredResources"] = int64(pool.Stat().AcquiredResources())
-	js["IdleResources"] = int64(pool.Stat().IdleResources())
-	js["TotalResources"] = int64(pool.Stat().TotalResources())
-	js["MaxResources"] = int64(pool.Stat().MaxResources())
+// PrintPoolState prints the stats of the pool, with the rates since the previous print.
+func PrintPoolState(pool *Pool) {
+	stats := pool.Stats()
+	pool.printed_mux.Lock()
+	if !pool.printed.Time.IsZero() {
+		stats.Rates = stats.RatesSince(pool.printed)
+	}
+	pool.printed = stats
+	pool.printed_mux.Unlock()
+
+	js := make(map[string]interface{})
+	js["AcquiredResources"] = stats.Acquired
+	js["IdleResources"] = stats.Idle
+	js["TotalResources"] = stats.Total
+	js["MaxResources"] = stats.Max
+	js["ConstructingResources"] = stats.Constructing
+	js["AcquireCount"] = stats.AcquireCount
+	js["AcquireDuration"] = stats.AcquireDuration.String()
+	js["CanceledAcquireCount"] = stats.CanceledAcquireCount
+	js["EmptyAcquireCount"] = stats.EmptyAcquireCount
+	js["QueuedAcquireCount"] = stats.QueuedAcquireCount
+	js["QueueDuration"] = stats.QueueDuration.String()
+	js["AcquiresPerSecond"] = stats.Rates.AcquiresPerSecond
+	js["MeanAcquireWait"] = stats.Rates.MeanWait.String()
+	js["EmptyAcquireRatio"] = stats.Rates.EmptyAcquireRatio
+	js["QueuedAcquireRatio"] = stats.Rates.QueuedAcquireRatio
+	js["Classes"] = stats.Classes
+	js["Tenants"] = stats.Tenants
+	js["Circuit"] = stats.Circuit
+	js["CircuitOpened"] = stats.CircuitOpened
 	jsonData, _ := json.Marshal(js)
 	fmt.Println(string(jsonData))
 }
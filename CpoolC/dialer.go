@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"common/dialer"
+)
+
+// Transport of the pool connections
+var (
+	server        = flag.String("server", "127.0.0.1:8080", "Address of the server")
+	network       = flag.String("network", "tcp", "Transport to the server: tcp, unix, tls, http-connect or socks5")
+	unix_socket   = flag.String("unix-socket", "", "Path of the Unix domain socket of the server, with -network unix")
+	proxy         = flag.String("proxy", "", "Address of the proxy, with -network http-connect or socks5")
+	proxy_user    = flag.String("proxy-user", "", "user:password of the proxy, if it needs authentication")
+	dial_timeout  = flag.Duration("dial-timeout", 5*time.Second, "Max time to connect, with the TLS or proxy handshake")
+	keep_alive    = flag.Duration("keepalive", 30*time.Second, "Period of the TCP keepalive (negative: disabled)")
+	local_address = flag.String("local-address", "", "Local address of the connections (default: chosen by the system)")
+	tls_insecure  = flag.Bool("tls-insecure", false, "Do not verify the certificate of the server, with -network tls")
+)
+
+// NewDialer returns the dialer of the pool to the address, with the transport of the flags.
+// The redirects to another host are dialed over TCP when the transport is a Unix domain socket.
+func NewDialer(address string) (dialer.Dialer, error) {
+	tcp := dialer.TCPDialer{Address: address, Timeout: *dial_timeout, KeepAlive: *keep_alive}
+	if *local_address != "" {
+		local, err := net.ResolveTCPAddr("tcp", *local_address)
+		if err != nil {
+			return nil, err
+		}
+		tcp.LocalAddr = local
+	}
+	username, password := splitUserPassword(*proxy_user)
+
+	switch *network {
+	case "tcp":
+		return &tcp, nil
+	case "unix":
+		if address != *server {
+			return &tcp, nil
+		}
+		return &dialer.UnixDialer{Path: *unix_socket, Timeout: *dial_timeout}, nil
+	case "tls":
+		return &dialer.TLSDialer{TCPDialer: tcp, Config: &tls.Config{InsecureSkipVerify: *tls_insecure}}, nil
+	case "http-connect", "socks5":
+		if *proxy == "" {
+			return nil, fmt.Errorf("-network %s needs -proxy", *network)
+		}
+		tcp.Address = *proxy
+		if *network == "socks5" {
+			return &dialer.SOCKS5Dialer{TCPDialer: tcp, Target: address, Username: username, Password: password}, nil
+		}
+		return &dialer.HTTPConnectDialer{TCPDialer: tcp, Target: address, Username: username, Password: password}, nil
+	}
+	return nil, fmt.Errorf("unknown network %q", *network)
+}
+
+func splitUserPassword(value string) (string, string) {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+)
+
+// Diameter Overload Indication Conveyance (RFC 7683): the client advertises the loss algorithm in its requests,
+// and drops the share of its requests to a peer given by the reduction of the overload report of the peer.
+var doic_enabled = flag.Bool("doic", true, "Support DOIC: advertise OC-Supported-Features and abate the traffic to an overloaded server")
+
+const (
+	loss_algorithm   = datatype.Unsigned64(1) // OLR_DEFAULT_ALGO of OC-Feature-Vector
+	default_validity = 30 * time.Second       // without OC-Validity-Duration
+	max_validity     = 86400 * time.Second
+)
+
+// overloadReport is the overload report of a peer in force.
+type overloadReport struct {
+	sequence  uint64
+	reduction uint32 // percentage of the requests to drop
+	expires   time.Time
+}
+
+type overloadControl struct {
+	mux     sync.Mutex
+	reports map[string]*overloadReport // by peer address
+
+	throttled uint64 // requests dropped
+}
+
+var overload = &overloadControl{reports: make(map[string]*overloadReport)}
+
+// SupportedFeatures is the OC-Supported-Features AVP of the requests.
+func SupportedFeatures() *diam.AVP {
+	return diam.NewAVP(avp.OCSupportedFeatures, 0, 0, &diam.GroupedAVP{
+		AVP: []*diam.AVP{diam.NewAVP(avp.OCFeatureVector, 0, 0, loss_algorithm)},
+	})
+}
+
+// Admit reports whether a request may be sent to the peer, the requests above the reduction of its report are dropped.
+func (control *overloadControl) Admit(peer string) bool {
+	if !*doic_enabled {
+		return true
+	}
+	control.mux.Lock()
+	defer control.mux.Unlock()
+
+	report, ok := control.reports[peer]
+	if !ok {
+		return true
+	}
+	if time.Now().After(report.expires) {
+		delete(control.reports, peer)
+		if report.reduction > 0 {
+			log.Printf("DOIC: overload report of %s expired\n", peer)
+		}
+		return true
+	}
+	if report.reduction > 0 && uint32(rand.Intn(100)) < report.reduction {
+		control.throttled++
+		return false
+	}
+	return true
+}
+
+// Update takes the overload report of the answer of the peer, an older sequence number is ignored.
+func (control *overloadControl) Update(peer string, answer *diam.Message) {
+	if !*doic_enabled {
+		return
+	}
+	olr, err := answer.FindAVP(avp.OCOLR, 0)
+	if err != nil {
+		return
+	}
+	group, ok := olr.Data.(*diam.GroupedAVP)
+	if !ok {
+		return
+	}
+
+	report := &overloadReport{}
+	validity := default_validity
+	for _, a := range group.AVP {
+		switch a.Code {
+		case avp.OCSequenceNumber:
+			if value, ok := a.Data.(datatype.Unsigned64); ok {
+				report.sequence = uint64(value)
+			}
+		case avp.OCReductionPercentage:
+			if value, ok := a.Data.(datatype.Unsigned32); ok && value <= 100 {
+				report.reduction = uint32(value)
+			}
+		case avp.OCValidityDuration:
+			if value, ok := a.Data.(datatype.Unsigned32); ok {
+				validity = time.Duration(value) * time.Second
+			}
+		}
+	}
+	if validity > max_validity {
+		validity = max_validity
+	}
+	report.expires = time.Now().Add(validity)
+
+	control.mux.Lock()
+	defer control.mux.Unlock()
+
+	current, ok := control.reports[peer]
+	if ok && report.sequence <= current.sequence {
+		return
+	}
+	control.reports[peer] = report
+
+	// a validity of 0 ends the overload, the report is kept for its sequence number
+	if validity == 0 || report.reduction == 0 {
+		report.reduction = 0
+		report.expires = time.Now().Add(default_validity)
+		if ok && current.reduction > 0 {
+			log.Printf("DOIC: overload of %s ended (%d requests dropped)\n", peer, control.throttled)
+		}
+		return
+	}
+	log.Printf("DOIC: %s overloaded, drop %d%% of the requests for %s\n", peer, report.reduction, validity)
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"common/dialer"
+
+	"github.com/jackc/puddle/v2"
+)
+
+var pool_events = flag.Bool("pool-events", false, "Log the lifecycle events of the pool connections")
+
+// Hooks are callbacks on the lifecycle events of the connections of a pool, nil callbacks are skipped.
+// They are called without any lock of the pool held, so they may use the pool, and must be safe for concurrent use.
+type Hooks struct {
+	OnDial            func(connection net.Conn, duration time.Duration)
+	OnDialError       func(err error, duration time.Duration)
+	OnAcquire         func(connection net.Conn, wait time.Duration)
+	OnRelease         func(connection net.Conn, held time.Duration)
+	OnDestroy         func(connection net.Conn, reason error)
+	OnHealthCheckFail func(connection net.Conn, err error)
+}
+
+// ErrPoolReset is the reason of the connections destroyed by Reset or Close of the pool.
+var ErrPoolReset = errors.New("pool reset or closed")
+
+// Pool is the puddle pool of the connections to a server, with the hooks.
+type Pool struct {
+	*puddle.Pool[net.Conn]
+	hooks *Hooks
+
+	// reasons of the Destroy calls, until the destructor of the connection runs
+	destroyed sync.Map // net.Conn -> error
+
+	// admits the acquires by priority
+	scheduler *acquireScheduler
+
+	// fails fast while the server is down, nil: no breaker
+	breaker *CircuitBreaker
+
+	// counters of the stats
+	waiting       int64 // Acquire calls in progress
+	dial_failures uint64
+	destroys_mux  sync.Mutex
+	destroys      map[string]uint64 // by kind of reason
+
+	// last stats printed by PrintPoolState, for the rates
+	printed_mux sync.Mutex
+	printed     PoolStats
+
+	// samplers of the subscriptions, by interval
+	samplers_mux sync.Mutex
+	samplers     map[time.Duration]*sampler
+
+	close_once sync.Once
+	closed     chan struct{} // closed by Close, stops the subscriptions
+}
+
+// NewPool creates the pool of max_size connections opened by the transport, the hooks may be nil.
+func NewPool(transport dialer.Dialer, max_size int32, hooks *Hooks) (*Pool, error) {
+	p := &Pool{
+		hooks:     hooks,
+		scheduler: newAcquireScheduler(max_size),
+		destroys:  make(map[string]uint64),
+		samplers:  make(map[time.Duration]*sampler),
+		closed:    make(chan struct{}),
+	}
+	pool, err := puddle.NewPool(
+		&puddle.Config[net.Conn]{
+			Constructor: func(ctx context.Context) (net.Conn, error) { return p.dial(ctx, transport) },
+			Destructor:  p.destroy,
+			MaxSize:     max_size,
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	p.Pool = pool
+	return p, nil
+}
+
+func (p *Pool) dial(ctx context.Context, transport dialer.Dialer) (net.Conn, error) {
+	if err := p.breaker.AllowDial(); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	connection, err := transport.Dial(ctx)
+	if err != nil {
+		atomic.AddUint64(&p.dial_failures, 1)
+		p.breaker.Failure()
+		if p.hooks != nil && p.hooks.OnDialError != nil {
+			p.hooks.OnDialError(err, time.Since(start))
+		}
+		return nil, err
+	}
+	if p.hooks != nil && p.hooks.OnDial != nil {
+		p.hooks.OnDial(connection, time.Since(start))
+	}
+	return connection, nil
+}
+
+// destroy is the destructor of the connections, run by puddle in its own goroutine.
+func (p *Pool) destroy(connection net.Conn) {
+	CloseConnection(connection)
+	reason, ok := p.destroyed.LoadAndDelete(connection)
+	if !ok {
+		reason = ErrPoolReset
+	}
+	p.destroys_mux.Lock()
+	p.destroys[destroyKind(reason.(error))]++
+	p.destroys_mux.Unlock()
+	if p.hooks != nil && p.hooks.OnDestroy != nil {
+		p.hooks.OnDestroy(connection, reason.(error))
+	}
+}
+
+// Resource is a connection acquired from the pool.
+type Resource struct {
+	*puddle.Resource[net.Conn]
+	pool      *Pool
+	acquired  time.Time
+	tenant    string
+	scheduled bool // admitted or held by the scheduler, until released or destroyed
+	held      bool // acquired by AcquireAllIdle, held by the scheduler
+	failed    bool // failure reported to the circuit breaker
+}
+
+// Acquire returns a connection of the pool with the normal priority, a new connection is created if none is idle and the pool is not full.
+func (p *Pool) Acquire(ctx context.Context) (*Resource, error) {
+	return p.AcquirePriority(ctx, PriorityNormal)
+}
+
+// AcquirePriority returns a connection of the pool, the waiters of the higher classes are served first.
+func (p *Pool) AcquirePriority(ctx context.Context, priority Priority) (*Resource, error) {
+	return p.AcquireFor(ctx, "", priority)
+}
+
+// AcquireFor returns a connection of the pool to the tenant, the waiters of the higher classes are served first,
+// then the tenants by weighted fair queueing.
+func (p *Pool) AcquireFor(ctx context.Context, tenant string, priority Priority) (*Resource, error) {
+	if err := p.breaker.Allow(); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	atomic.AddInt64(&p.waiting, 1)
+	defer atomic.AddInt64(&p.waiting, -1)
+
+	if err := p.scheduler.Wait(ctx, tenant, priority); err != nil {
+		return nil, err
+	}
+	res, err := p.Pool.Acquire(ctx)
+	if err != nil {
+		p.scheduler.Done(tenant)
+		return nil, err
+	}
+	resource := p.acquired(res, start)
+	resource.tenant = tenant
+	resource.scheduled = true
+	return resource, nil
+}
+
+// Reserve keeps n connections of the pool for the class and the higher ones, none can be reserved to PriorityLow.
+func (p *Pool) Reserve(priority Priority, n int32) error {
+	return p.scheduler.Reserve(priority, n)
+}
+
+// done ends the admission of the resource by the scheduler, once, and feeds the circuit breaker with its result.
+// The connections of the health checks are only held, the server closing its idle connections is not a failure.
+func (r *Resource) done(err error) {
+	if !r.scheduled {
+		return
+	}
+	r.scheduled = false
+	if r.held {
+		r.pool.scheduler.Unhold()
+		return
+	}
+	r.pool.scheduler.Done(r.tenant)
+	if r.failed {
+		return
+	}
+	if err != nil {
+		r.pool.breaker.Failure()
+	} else {
+		r.pool.breaker.Success()
+	}
+}
+
+// AcquireAllIdle returns the idle connections of the pool, held by the scheduler until they are released or destroyed.
+func (p *Pool) AcquireAllIdle() []*Resource {
+	start := time.Now()
+	idle := p.Pool.AcquireAllIdle()
+	p.scheduler.Hold(int32(len(idle)))
+	resources := make([]*Resource, len(idle))
+	for i, res := range idle {
+		resources[i] = p.acquired(res, start)
+		resources[i].scheduled, resources[i].held = true, true
+	}
+	return resources
+}
+
+func (p *Pool) acquired(res *puddle.Resource[net.Conn], start time.Time) *Resource {
+	now := time.Now()
+	if p.hooks != nil && p.hooks.OnAcquire != nil {
+		p.hooks.OnAcquire(res.Value(), now.Sub(start))
+	}
+	return &Resource{Resource: res, pool: p, acquired: now}
+}
+
+// Release returns the connection to the pool.
+func (r *Resource) Release() {
+	connection, held := r.Value(), time.Since(r.acquired)
+	r.Resource.Release()
+	r.done(nil)
+	if r.pool.hooks != nil && r.pool.hooks.OnRelease != nil {
+		r.pool.hooks.OnRelease(connection, held)
+	}
+}
+
+// Destroy closes the connection and removes it from the pool, the reason is passed to OnDestroy.
+func (r *Resource) Destroy(reason error) {
+	r.pool.destroyed.Store(r.Value(), reason)
+	r.Resource.Destroy()
+	r.done(reason)
+}
+
+// HealthCheckError is the reason of the connections destroyed by a failed health check.
+type HealthCheckError struct {
+	Err error
+}
+
+func (e *HealthCheckError) Error() string { return "health check: " + e.Err.Error() }
+
+func (e *HealthCheckError) Unwrap() error { return e.Err }
+
+// HealthCheckFailed reports the failed check of an idle connection, and destroys it.
+func (r *Resource) HealthCheckFailed(err error) {
+	if r.pool.hooks != nil && r.pool.hooks.OnHealthCheckFail != nil {
+		r.pool.hooks.OnHealthCheckFail(r.Value(), err)
+	}
+	r.Destroy(&HealthCheckError{Err: err})
+}
+
+// LogHooks log every event of the pool to the address.
+func LogHooks(address string) *Hooks {
+	return &Hooks{
+		OnDial: func(connection net.Conn, duration time.Duration) {
+			log.Printf("Pool %s: dialed %s in %s\n", address, connection.LocalAddr(), duration)
+		},
+		OnDialError: func(err error, duration time.Duration) {
+			log.Printf("Pool %s: dial failed in %s: %v\n", address, duration, err)
+		},
+		OnAcquire: func(connection net.Conn, wait time.Duration) {
+			log.Printf("Pool %s: acquired %s after %s\n", address, connection.LocalAddr(), wait)
+		},
+		OnRelease: func(connection net.Conn, held time.Duration) {
+			log.Printf("Pool %s: released %s held %s\n", address, connection.LocalAddr(), held)
+		},
+		OnDestroy: func(connection net.Conn, reason error) {
+			log.Printf("Pool %s: destroyed %s: %v\n", address, connection.LocalAddr(), reason)
+		},
+		OnHealthCheckFail: func(connection net.Conn, err error) {
+			log.Printf("Pool %s: health check of %s failed: %v\n", address, connection.LocalAddr(), err)
+		},
+	}
+}
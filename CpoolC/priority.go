@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+)
+
+var priority_reserved = flag.String("priority-reserved", "", "Connections reserved to a priority class and the higher ones, e.g. \"high:2,normal:1\"")
+
+// Priority is the class of an acquire: when the pool is exhausted, the waiters of the higher classes get the connections first.
+type Priority int
+
+const (
+	PriorityLow    Priority = iota // interim accounting
+	PriorityNormal                 // default of Acquire
+	PriorityHigh                   // credit control
+	num_priorities
+)
+
+var priority_names = [num_priorities]string{"low", "normal", "high"}
+
+func (priority Priority) String() string {
+	if priority < 0 || priority >= num_priorities {
+		return strconv.Itoa(int(priority))
+	}
+	return priority_names[priority]
+}
+
+func ParsePriority(name string) (Priority, error) {
+	for priority, priority_name := range priority_names {
+		if name == priority_name {
+			return Priority(priority), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown priority %q", name)
+}
+
+// ParseReserved parses the reserved connections of the classes, "high:2,normal:1".
+func ParseReserved(value string) (map[Priority]int32, error) {
+	reserved := make(map[Priority]int32)
+	if value == "" {
+		return reserved, nil
+	}
+	for _, class := range strings.Split(value, ",") {
+		parts := strings.SplitN(class, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid reserved class %q", class)
+		}
+		priority, err := ParsePriority(strings.TrimSpace(parts[0]))
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 31)
+		if err != nil {
+			return nil, fmt.Errorf("invalid reserved class %q: %v", class, err)
+		}
+		reserved[priority] = int32(n)
+	}
+	return reserved, nil
+}
+
+// ReserveClasses reserves the connections of the classes in the pool.
+func (p *Pool) ReserveClasses(reserved map[Priority]int32) error {
+	for priority, n := range reserved {
+		if err := p.Reserve(priority, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PriorityOf classifies a request: Credit-Control is high, interim Accounting-Requests are low.
+func PriorityOf(message *diam.Message) Priority {
+	switch message.Header.CommandCode {
+	case diam.CreditControl:
+		return PriorityHigh
+	case diam.Accounting:
+		if record_type, err := message.FindAVP(avp.AccountingRecordType, 0); err == nil {
+			if value, ok := record_type.Data.(datatype.Enumerated); ok && value == 3 { // INTERIM_RECORD
+				return PriorityLow
+			}
+		}
+	}
+	return PriorityNormal
+}
+
+// ClassStats are the acquire statistics of a priority class, since the pool was created.
+type ClassStats struct {
+	Acquires     uint64
+	Waited       uint64        // acquires that waited for a connection
+	WaitDuration time.Duration // total wait of the acquires
+	Canceled     uint64        // acquires ended by their context while waiting
+	Waiting      int           // acquires waiting now
+	Reserved     int32
+}
+
+// MeanWait is the mean wait of the acquires of the class.
+func (s ClassStats) MeanWait() time.Duration {
+	if s.Acquires == 0 {
+		return 0
+	}
+	return s.WaitDuration / time.Duration(s.Acquires)
+}
+
+// acquireScheduler admits the acquires of the pool by priority. A class may hold the connections of the pool
+// except the ones reserved to the higher classes. Within a class, the waiters of the tenants are served by
+// weighted fair queueing, and a tenant never holds more than its max connections.
+type acquireScheduler struct {
+	mux      sync.Mutex
+	max      int32
+	in_use   int32
+	reserved [num_priorities]int32
+	waiters  [num_priorities][]*acquireWaiter
+	stats    [num_priorities]ClassStats
+
+	tenants      map[string]*tenant
+	virtual_time float64 // tag of the last waiter admitted
+}
+
+// acquireWaiter is an acquire waiting for its admission, served in the order of the tags of its class.
+type acquireWaiter struct {
+	ready  chan struct{}
+	tenant *tenant
+	tag    float64
+}
+
+func newAcquireScheduler(max int32) *acquireScheduler {
+	return &acquireScheduler{max: max, tenants: make(map[string]*tenant)}
+}
+
+// Reserve keeps n connections of the pool for the class and the higher ones, the lowest class keeps at least one connection.
+func (s *acquireScheduler) Reserve(priority Priority, n int32) error {
+	if priority < 0 || priority >= num_priorities {
+		return fmt.Errorf("unknown priority %s", priority)
+	}
+	if priority == PriorityLow && n != 0 {
+		// every class may use the connections of the lowest one
+		return fmt.Errorf("%s: connections can not be reserved to the lowest class", priority)
+	}
+	if n < 0 {
+		return fmt.Errorf("%s: %d connections reserved is negative", priority, n)
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	previous := s.reserved[priority]
+	s.reserved[priority] = n
+	if s.limit(PriorityLow) < 1 {
+		s.reserved[priority] = previous
+		return fmt.Errorf("%s: %d connections reserved, the pool has %d", priority, n, s.max)
+	}
+	s.grant()
+	return nil
+}
+
+// limit is the number of connections in use under which the class is admitted.
+func (s *acquireScheduler) limit(priority Priority) int32 {
+	limit := s.max
+	for higher := priority + 1; higher < num_priorities; higher++ {
+		limit -= s.reserved[higher]
+	}
+	return limit
+}
+
+// Wait returns when the acquire of the tenant is admitted, or with the error of the context.
+func (s *acquireScheduler) Wait(ctx context.Context, tenant_name string, priority Priority) error {
+	start := time.Now()
+	s.mux.Lock()
+	t := s.tenant(tenant_name)
+	queued := false
+	for higher := priority; higher < num_priorities; higher++ {
+		queued = queued || s.next(higher) >= 0
+	}
+	if !queued && s.in_use < s.limit(priority) && t.admits() {
+		s.admit(t, priority)
+		s.mux.Unlock()
+		return nil
+	}
+	waiter := &acquireWaiter{ready: make(chan struct{}), tenant: t, tag: t.nextTag(s.virtual_time)}
+	s.waiters[priority] = append(s.waiters[priority], waiter)
+	t.waiting++
+	s.mux.Unlock()
+
+	select {
+	case <-waiter.ready:
+		wait := time.Since(start)
+		s.mux.Lock()
+		s.stats[priority].Waited++
+		s.stats[priority].WaitDuration += wait
+		t.stats.Waited++
+		t.stats.WaitDuration += wait
+		s.mux.Unlock()
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.stats[priority].Canceled++
+	t.stats.Canceled++
+	for i, other := range s.waiters[priority] {
+		if other == waiter {
+			s.waiters[priority] = append(s.waiters[priority][:i], s.waiters[priority][i+1:]...)
+			t.waiting--
+			s.evict(tenant_name, t)
+			return ctx.Err()
+		}
+	}
+	// admitted meanwhile, give the connection to the next waiter
+	s.in_use--
+	t.in_use--
+	s.evict(tenant_name, t)
+	s.grant()
+	return ctx.Err()
+}
+
+// admit counts an admitted acquire. The caller holds the lock.
+func (s *acquireScheduler) admit(t *tenant, priority Priority) {
+	s.in_use++
+	t.in_use++
+	s.stats[priority].Acquires++
+	t.stats.Acquires++
+}
+
+// Done ends an admitted acquire of the tenant, when its connection is released or destroyed.
+func (s *acquireScheduler) Done(tenant_name string) {
+	s.mux.Lock()
+	s.in_use--
+	t := s.tenant(tenant_name)
+	t.in_use--
+	s.evict(tenant_name, t)
+	s.grant()
+	s.mux.Unlock()
+}
+
+// Hold counts n connections held outside the acquires, the health checks of the idle connections,
+// so the scheduler does not admit acquires that would wait for them in the pool.
+func (s *acquireScheduler) Hold(n int32) {
+	s.mux.Lock()
+	s.in_use += n
+	s.mux.Unlock()
+}
+
+// Unhold ends the hold of a connection, when it is released or destroyed.
+func (s *acquireScheduler) Unhold() {
+	s.mux.Lock()
+	s.in_use--
+	s.grant()
+	s.mux.Unlock()
+}
+
+// next returns the index of the waiter of the class with the lowest tag, among the tenants under their max, or -1.
+// The caller holds the lock.
+func (s *acquireScheduler) next(priority Priority) int {
+	next := -1
+	for i, waiter := range s.waiters[priority] {
+		if waiter.tenant.admits() && (next < 0 || waiter.tag < s.waiters[priority][next].tag) {
+			next = i
+		}
+	}
+	return next
+}
+
+// grant admits the waiters, highest class first. The caller holds the lock.
+func (s *acquireScheduler) grant() {
+	for priority := num_priorities - 1; priority >= 0; priority-- {
+		for {
+			next := s.next(priority)
+			if next < 0 {
+				// no waiter, or their tenants are at their max: the lower classes may use the connections
+				break
+			}
+			if s.in_use >= s.limit(priority) {
+				// the lower classes have a lower limit
+				return
+			}
+			waiter := s.waiters[priority][next]
+			s.waiters[priority] = append(s.waiters[priority][:next], s.waiters[priority][next+1:]...)
+			waiter.tenant.waiting--
+			if waiter.tag > s.virtual_time {
+				s.virtual_time = waiter.tag
+			}
+			s.admit(waiter.tenant, priority)
+			close(waiter.ready)
+		}
+	}
+}
+
+// Stats returns the statistics of the classes, by name.
+func (s *acquireScheduler) Stats() map[string]ClassStats {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	classes := make(map[string]ClassStats, num_priorities)
+	for priority := Priority(0); priority < num_priorities; priority++ {
+		stats := s.stats[priority]
+		stats.Waiting = len(s.waiters[priority])
+		stats.Reserved = s.reserved[priority]
+		classes[priority.String()] = stats
+	}
+	return classes
+}
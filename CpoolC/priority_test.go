@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestReserve(t *testing.T) {
+	tests := []struct {
+		name     string
+		priority Priority
+		n        int32
+		ok       bool
+	}{
+		{"normal", PriorityNormal, 2, true},
+		{"high", PriorityHigh, 7, true},
+		{"lowest class", PriorityLow, 1, false},
+		{"lowest class without connection", PriorityLow, 0, true},
+		{"whole pool", PriorityHigh, 8, false},
+		{"negative", PriorityNormal, -1, false},
+		{"unknown priority", num_priorities, 1, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newAcquireScheduler(8)
+			err := s.Reserve(test.priority, test.n)
+			if (err == nil) != test.ok {
+				t.Errorf("Reserve(%s, %d): %v", test.priority, test.n, err)
+			}
+			if err != nil && test.priority >= 0 && test.priority < num_priorities && s.reserved[test.priority] != 0 {
+				t.Errorf("rejected reserve kept: %d", s.reserved[test.priority])
+			}
+		})
+	}
+}
+
+func TestReservedClass(t *testing.T) {
+	s := newAcquireScheduler(2)
+	if err := s.Reserve(PriorityHigh, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Wait(context.Background(), "", PriorityLow); err != nil {
+		t.Fatal(err)
+	}
+
+	// the last connection is reserved to the high class
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := s.Wait(ctx, "", PriorityNormal); err == nil {
+		t.Error("normal acquire admitted on the reserved connection")
+	}
+	if err := s.Wait(context.Background(), "", PriorityHigh); err != nil {
+		t.Error(err)
+	}
+	if stats := s.Stats(); stats["normal"].Canceled != 1 || stats["high"].Acquires != 1 || stats["high"].Reserved != 1 {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+func TestHold(t *testing.T) {
+	s := newAcquireScheduler(1)
+	s.Hold(1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := s.Wait(ctx, "", PriorityHigh); err == nil {
+		t.Error("acquire admitted on a held connection")
+	}
+	s.Unhold()
+	if err := s.Wait(context.Background(), "", PriorityHigh); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"common/inbound"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+)
+
+// Redirects: an answer DIAMETER_REDIRECT_INDICATION sends the request again to its Redirect-Host, through a pool
+// to that host. The redirect is cached for the requests matching its Redirect-Host-Usage, for Redirect-Max-Cache-Time.
+var max_redirects = flag.Int("max-redirects", 3, "Max number of redirects followed by a request (0: redirects not followed)")
+
+// Redirect-Host-Usage values
+const (
+	dont_cache            = 0
+	all_session           = 1
+	all_realm             = 2
+	realm_and_application = 3
+	all_application       = 4
+	all_host              = 5
+	all_user              = 6
+)
+
+// precedence of the cached redirects matching a request, RFC 6733 section 6.13
+var redirect_precedence = []int32{all_session, all_user, realm_and_application, all_realm, all_application, all_host}
+
+const default_diameter_port = "3868"
+
+type redirectKey struct {
+	usage int32
+	value string
+}
+
+type redirectEntry struct {
+	host    *net.TCPAddr
+	expires time.Time
+}
+
+type redirectCache struct {
+	mux     sync.Mutex
+	entries map[redirectKey]*redirectEntry
+}
+
+var redirects = &redirectCache{entries: make(map[redirectKey]*redirectEntry)}
+
+// newRedirectKey returns the key of the request for a Redirect-Host-Usage, false if the request has not the AVPs of the key.
+func newRedirectKey(request *diam.Message, usage int32) (redirectKey, bool) {
+	value := func(code uint32) string {
+		if a, err := request.FindAVP(code, 0); err == nil {
+			return string(a.Data.Serialize())
+		}
+		return ""
+	}
+
+	key := redirectKey{usage: usage}
+	switch usage {
+	case all_session:
+		key.value = value(avp.SessionID)
+	case all_realm:
+		key.value = value(avp.DestinationRealm)
+	case realm_and_application:
+		if realm := value(avp.DestinationRealm); realm != "" {
+			key.value = fmt.Sprintf("%s/%d", realm, request.Header.ApplicationID)
+		}
+	case all_application:
+		key.value = fmt.Sprint(request.Header.ApplicationID)
+	case all_host:
+		key.value = value(avp.DestinationHost)
+	case all_user:
+		key.value = value(avp.UserName)
+	}
+	return key, key.value != ""
+}
+
+// Lookup returns the host of the cached redirect of the request, or the default host.
+func (cache *redirectCache) Lookup(request *diam.Message, default_host *net.TCPAddr) *net.TCPAddr {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+
+	now := time.Now()
+	for _, usage := range redirect_precedence {
+		key, ok := newRedirectKey(request, usage)
+		if !ok {
+			continue
+		}
+		entry, ok := cache.entries[key]
+		if !ok {
+			continue
+		}
+		if now.After(entry.expires) {
+			delete(cache.entries, key)
+			continue
+		}
+		return entry.host
+	}
+	return default_host
+}
+
+// Follow returns the host the request is redirected to by the answer, and caches the redirect.
+func (cache *redirectCache) Follow(request, answer *diam.Message) (*net.TCPAddr, bool) {
+	if result_code, err := answer.FindAVP(avp.ResultCode, 0); err != nil || result_code.Data != datatype.Unsigned32(diam.RedirectIndication) {
+		return nil, false
+	}
+
+	var host *net.TCPAddr
+	redirect_hosts, _ := answer.FindAVPs(avp.RedirectHost, 0)
+	for _, redirect_host := range redirect_hosts {
+		address, err := parseDiameterURI(string(redirect_host.Data.Serialize()))
+		if err != nil {
+			log.Printf("Redirect-Host %v: %v\n", redirect_host.Data, err)
+			continue
+		}
+		host = address
+		break
+	}
+	if host == nil {
+		return nil, false
+	}
+
+	var usage int32 = dont_cache
+	if a, err := answer.FindAVP(avp.RedirectHostUsage, 0); err == nil {
+		if value, ok := a.Data.(datatype.Enumerated); ok {
+			usage = int32(value)
+		}
+	}
+	var cache_time time.Duration
+	if a, err := answer.FindAVP(avp.RedirectMaxCacheTime, 0); err == nil {
+		if value, ok := a.Data.(datatype.Unsigned32); ok {
+			cache_time = time.Duration(value) * time.Second
+		}
+	}
+
+	if key, ok := newRedirectKey(request, usage); ok && usage != dont_cache && cache_time > 0 {
+		cache.mux.Lock()
+		cache.entries[key] = &redirectEntry{host: host, expires: time.Now().Add(cache_time)}
+		cache.mux.Unlock()
+	}
+	return host, true
+}
+
+// parseDiameterURI returns the address of a DiameterURI "aaa://host:port;transport=tcp".
+func parseDiameterURI(uri string) (*net.TCPAddr, error) {
+	host := uri
+	for _, scheme := range []string{"aaa://", "aaas://"} {
+		host = strings.TrimPrefix(host, scheme)
+	}
+	if i := strings.IndexByte(host, ';'); i >= 0 {
+		host = host[:i]
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, default_diameter_port)
+	}
+	return net.ResolveTCPAddr("tcp", host)
+}
+
+// hostPools are the pools to the hosts of the redirects, by address.
+type hostPools struct {
+	mux      sync.Mutex
+	max_size int32
+	reserved map[Priority]int32
+	tenants  []TenantConfig
+	pools    map[string]*Pool
+}
+
+var redirect_pools = &hostPools{pools: make(map[string]*Pool)}
+
+// Get returns the pool to the address, a new pool is created on the first redirect to it.
+func (p *hostPools) Get(address *net.TCPAddr) (*Pool, error) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	if pool, ok := p.pools[address.String()]; ok {
+		return pool, nil
+	}
+	dialer, err := NewDialer(address.String())
+	if err != nil {
+		return nil, err
+	}
+	var hooks *Hooks
+	if *pool_events {
+		hooks = LogHooks(address.String())
+	}
+	pool, err := NewPool(dialer, p.max_size, hooks)
+	if err != nil {
+		return nil, err
+	}
+	pool.SetCircuitBreaker(NewCircuitBreaker(address.String(), *breaker_failures, *breaker_open_time, *breaker_probes))
+	if err := pool.ReserveClasses(p.reserved); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	if err := pool.SetTenants(p.tenants); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	if err := PublishStats(address.String(), pool); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	p.pools[address.String()] = pool
+	log.Printf("Created pool to %s\n", address)
+	return pool, nil
+}
+
+// Close prints the state of the pools and closes them.
+func (p *hostPools) Close() {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	for address, pool := range p.pools {
+		fmt.Printf("Pool to %s: ", address)
+		PrintPoolState(pool)
+		pool.Close()
+		delete(p.pools, address)
+	}
+}
+
+// sendRequest sends the request of the tenant on a connection of the pool to the server and reads its answer,
+// with the latency breakdown. The caller releases the connection, it is destroyed on error.
+func sendRequest(pool *Pool, tenant string, msg *diam.Message) (*Resource, *diam.Message, Latency, error) {
+	timing := requestTiming{acquire: time.Now()}
+
+	// Return a connection managed by pool
+	// If the pool has not idle connection and the total connection of the pool are less than maxPoolSize then Acquire method will create new connection .
+	res, err := pool.AcquireFor(context.Background(), tenant, PriorityOf(msg))
+	if err != nil {
+		return nil, nil, Latency{}, err
+	}
+	timing.acquired = time.Now()
+
+	res.Value().SetDeadline(time.Time{})
+
+	// Send message to server
+	if _, err = msg.WriteTo(res.Value()); err != nil {
+		res.Destroy(err)
+		return nil, nil, Latency{}, err
+	}
+
+	// receive message from server
+	response, err := inbound.ReadAnswer(res.Value(), msg.Header.HopByHopID)
+	if err != nil {
+		res.Destroy(err)
+		return nil, nil, Latency{}, err
+	}
+	timing.answered = time.Now()
+	res.CheckAnswer(response)
+	return res, response, NewLatency(timing, response), nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"common/inbound"
+	"common/recording"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/dict"
+)
+
+var (
+	replay_file    = flag.String("replay", "", "Replay a recording of the test server (CpoolS -record) through the pool")
+	replay_speed   = flag.Float64("replay-speed", 1, "Speed of the replay: 1 keeps the recorded timing, 2 is twice as fast, 0 sends without waiting")
+	replay_timeout = flag.Duration("replay-timeout", 3*time.Second, "Max time to wait for an answer of a replayed request")
+)
+
+type replayResult struct {
+	sent     uint64
+	answered uint64
+	failed   uint64
+}
+
+// Replay re-sends the recorded requests through the pool, keeping their relative timing divided by speed.
+func Replay(pool *Pool, file string, speed float64) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var wg sync.WaitGroup
+	var result replayResult
+	var first time.Time
+	start := time.Now()
+
+	reader := recording.NewReader(f)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			wg.Wait()
+			return err
+		}
+
+		if first.IsZero() {
+			first = record.Time
+		}
+		if speed > 0 {
+			time.Sleep(time.Until(start.Add(time.Duration(float64(record.Time.Sub(first)) / speed))))
+		}
+
+		wg.Add(1)
+		go ReplayTask(pool, record, &result, &wg)
+	}
+	wg.Wait()
+
+	log.Printf("Replayed %s in %s: sent %d, answered %d, failed %d\n", file, time.Since(start),
+		result.sent, result.answered, result.failed)
+	return nil
+}
+
+func ReplayTask(pool *Pool, record *recording.Record, result *replayResult, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	header, err := diam.DecodeHeader(record.Message)
+	if err != nil {
+		log.Println(err)
+		atomic.AddUint64(&result.failed, 1)
+		return
+	}
+
+	// the priority class needs the AVPs of the request
+	priority := PriorityNormal
+	if request, err := diam.ReadMessage(bytes.NewReader(record.Message), dict.Default); err == nil {
+		priority = PriorityOf(request)
+	}
+
+	// every recorded connection is a tenant of the pool
+	tenant := fmt.Sprintf("connection-%d", record.ConnectionID)
+	res, err := pool.AcquireFor(context.Background(), tenant, priority)
+	if err != nil {
+		log.Println(err)
+		atomic.AddUint64(&result.failed, 1)
+		return
+	}
+
+	res.Value().SetDeadline(time.Time{})
+
+	// Send the recorded bytes as they are
+	_, err = res.Value().Write(record.Message)
+	if err != nil {
+		log.Println(err)
+		atomic.AddUint64(&result.failed, 1)
+		res.Destroy(err)
+		return
+	}
+	atomic.AddUint64(&result.sent, 1)
+
+	if !record.Answered {
+		res.Release()
+		return
+	}
+
+	res.Value().SetReadDeadline(time.Now().Add(*replay_timeout))
+	response, err := inbound.ReadAnswer(res.Value(), header.HopByHopID)
+	if err != nil {
+		log.Println(err)
+		atomic.AddUint64(&result.failed, 1)
+		// the read may have stopped in the middle of a message
+		res.Destroy(err)
+		return
+	}
+	res.Value().SetReadDeadline(time.Time{})
+	atomic.AddUint64(&result.answered, 1)
+	res.CheckAnswer(response)
+
+	if result_code, err := response.FindAVP(avp.ResultCode, 0); err == nil {
+		log.Printf("Replayed request of connection %d: %s\n", record.ConnectionID, result_code.Data)
+	}
+
+	res.Release()
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+var stats_interval = flag.Duration("stats-interval", 10*time.Second, "Interval of the pool stats printed (0: disabled)")
+
+// kinds of the reasons of the destroyed connections, counted in the stats
+const (
+	destroy_reset        = "reset"
+	destroy_health_check = "health_check"
+	destroy_timeout      = "timeout"
+	destroy_closed       = "closed_by_peer"
+	destroy_error        = "error"
+)
+
+func destroyKind(reason error) string {
+	var health_check *HealthCheckError
+	var net_error net.Error
+	switch {
+	case errors.Is(reason, ErrPoolReset):
+		return destroy_reset
+	case errors.As(reason, &health_check):
+		return destroy_health_check
+	case errors.As(reason, &net_error) && net_error.Timeout():
+		return destroy_timeout
+	case errors.Is(reason, io.EOF), errors.Is(reason, io.ErrUnexpectedEOF):
+		return destroy_closed
+	}
+	return destroy_error
+}
+
+// PoolStats is a snapshot of the state of a pool. The snapshots are shared by the subscribers, they must not be modified.
+type PoolStats struct {
+	Time         time.Time
+	Acquired     int32
+	Idle         int32
+	Total        int32
+	Max          int32
+	Constructing int32                  // connections being dialed
+	Waiting      int64                  // Acquire calls waiting for a connection, or for the dial of a new one
+	DialFailures uint64                 // since the pool was created
+	Destroys     map[string]uint64      // since the pool was created, by kind of reason
+	Classes      map[string]ClassStats  // acquires by priority class
+	Tenants      map[string]TenantStats // acquires by tenant
+
+	Circuit       string // state of the circuit breaker
+	CircuitOpened uint64 // times the circuit opened
+
+	// acquire counters of puddle, since the pool was created
+	AcquireCount         int64
+	AcquireDuration      time.Duration // total time of the successful acquires in puddle, after their admission
+	CanceledAcquireCount int64         // acquires ended by their context
+	EmptyAcquireCount    int64         // successful acquires that waited for a connection, none was idle
+
+	// queueing of the acquires in the scheduler, before puddle: the pool is contended when its connections are all admitted
+	QueuedAcquireCount uint64        // acquires that waited for their admission
+	QueueDuration      time.Duration // total wait of the admitted acquires in the scheduler
+
+	Rates PoolRates // since the previous snapshot of the sampler
+}
+
+// PoolRates are derived from two snapshots of the stats.
+type PoolRates struct {
+	Interval              time.Duration
+	AcquiresPerSecond     float64
+	MeanWait              time.Duration // mean duration of the acquires, queued in the scheduler and in puddle
+	EmptyAcquireRatio     float64       // share of the acquires that waited for a connection in puddle
+	QueuedAcquireRatio    float64       // share of the acquires that waited for their admission in the scheduler
+	CanceledPerSecond     float64
+	DialFailuresPerSecond float64
+}
+
+// RatesSince computes the rates between the previous snapshot and this one.
+func (s PoolStats) RatesSince(previous PoolStats) PoolRates {
+	rates := PoolRates{Interval: s.Time.Sub(previous.Time)}
+	if rates.Interval <= 0 {
+		return PoolRates{}
+	}
+	seconds := rates.Interval.Seconds()
+	acquires := s.AcquireCount - previous.AcquireCount
+	rates.AcquiresPerSecond = float64(acquires) / seconds
+	rates.CanceledPerSecond = float64(s.CanceledAcquireCount-previous.CanceledAcquireCount) / seconds
+	rates.DialFailuresPerSecond = float64(s.DialFailures-previous.DialFailures) / seconds
+	if acquires > 0 {
+		wait := s.AcquireDuration - previous.AcquireDuration + s.QueueDuration - previous.QueueDuration
+		rates.MeanWait = wait / time.Duration(acquires)
+		rates.EmptyAcquireRatio = float64(s.EmptyAcquireCount-previous.EmptyAcquireCount) / float64(acquires)
+		rates.QueuedAcquireRatio = float64(s.QueuedAcquireCount-previous.QueuedAcquireCount) / float64(acquires)
+	}
+	return rates
+}
+
+// Stats returns a snapshot of the state of the pool.
+func (p *Pool) Stats() PoolStats {
+	stat := p.Stat()
+	stats := PoolStats{
+		Time:         time.Now(),
+		Acquired:     stat.AcquiredResources(),
+		Idle:         stat.IdleResources(),
+		Total:        stat.TotalResources(),
+		Max:          stat.MaxResources(),
+		Constructing: stat.ConstructingResources(),
+		Waiting:      atomic.LoadInt64(&p.waiting),
+		DialFailures: atomic.LoadUint64(&p.dial_failures),
+		Destroys:     make(map[string]uint64),
+		Classes:      p.scheduler.Stats(),
+		Tenants:      p.scheduler.TenantStats(),
+
+		AcquireCount:         stat.AcquireCount(),
+		AcquireDuration:      stat.AcquireDuration(),
+		CanceledAcquireCount: stat.CanceledAcquireCount(),
+		EmptyAcquireCount:    stat.EmptyAcquireCount(),
+	}
+	for _, class := range stats.Classes {
+		stats.QueuedAcquireCount += class.Waited
+		stats.QueueDuration += class.WaitDuration
+	}
+	state, opened := p.breaker.State()
+	stats.Circuit, stats.CircuitOpened = state.String(), opened
+
+	p.destroys_mux.Lock()
+	for kind, n := range p.destroys {
+		stats.Destroys[kind] = n
+	}
+	p.destroys_mux.Unlock()
+	return stats
+}
+
+// subscription_buffer is the number of snapshots a subscriber may lag behind before it is dropped
+const subscription_buffer = 4
+
+// sampler takes the snapshots of the stats every interval and sends them to its subscribers.
+type sampler struct {
+	interval    time.Duration
+	subscribers map[chan PoolStats]struct{}
+}
+
+// Subscribe returns a channel receiving a snapshot of the stats every interval, until the pool is closed or unsubscribe is called.
+// The subscribers of the same interval share one sampler, so the pool is sampled once per interval whatever their number.
+// A subscriber not reading its snapshots is dropped, its channel is closed, so it never blocks the pool or the other subscribers.
+func (p *Pool) Subscribe(interval time.Duration) (snapshots <-chan PoolStats, unsubscribe func(), err error) {
+	if interval <= 0 {
+		return nil, nil, fmt.Errorf("stats interval %s is not positive", interval)
+	}
+	channel := make(chan PoolStats, subscription_buffer)
+	p.samplers_mux.Lock()
+	defer p.samplers_mux.Unlock()
+	select {
+	case <-p.closed:
+		close(channel)
+		return channel, func() {}, nil
+	default:
+	}
+	s, ok := p.samplers[interval]
+	if !ok {
+		s = &sampler{interval: interval, subscribers: make(map[chan PoolStats]struct{})}
+		p.samplers[interval] = s
+		go p.sample(s)
+	}
+	s.subscribers[channel] = struct{}{}
+	return channel, func() { p.unsubscribe(s, channel) }, nil
+}
+
+// unsubscribe closes the channel of the subscriber, once, and stops the sampler without subscribers.
+// The caller must not hold samplers_mux.
+func (p *Pool) unsubscribe(s *sampler, channel chan PoolStats) {
+	p.samplers_mux.Lock()
+	defer p.samplers_mux.Unlock()
+	p.drop(s, channel)
+}
+
+// drop removes the subscriber from the sampler. The caller holds samplers_mux.
+func (p *Pool) drop(s *sampler, channel chan PoolStats) {
+	if _, ok := s.subscribers[channel]; !ok {
+		return
+	}
+	delete(s.subscribers, channel)
+	close(channel)
+	if len(s.subscribers) == 0 && p.samplers[s.interval] == s {
+		delete(p.samplers, s.interval)
+	}
+}
+
+// sample is the goroutine of the sampler, it ends with its last subscriber or when the pool is closed.
+func (p *Pool) sample(s *sampler) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	previous := p.Stats()
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.closed:
+			p.samplers_mux.Lock()
+			for channel := range s.subscribers {
+				p.drop(s, channel)
+			}
+			p.samplers_mux.Unlock()
+			return
+		}
+		stats := p.Stats()
+		stats.Rates = stats.RatesSince(previous)
+		previous = stats
+
+		p.samplers_mux.Lock()
+		if len(s.subscribers) == 0 {
+			p.samplers_mux.Unlock()
+			return
+		}
+		for channel := range s.subscribers {
+			select {
+			case channel <- stats:
+			default:
+				// slow subscriber
+				p.drop(s, channel)
+			}
+		}
+		p.samplers_mux.Unlock()
+	}
+}
+
+// Close closes the connections of the pool and ends the subscriptions.
+func (p *Pool) Close() {
+	p.close_once.Do(func() { close(p.closed) })
+	p.Pool.Close()
+}
+
+// PrintStats prints the snapshots of a subscription.
+func PrintStats(address string, snapshots <-chan PoolStats) {
+	for stats := range snapshots {
+		data, _ := json.Marshal(stats)
+		fmt.Printf("Pool %s: %s\n", address, data)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"flag"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	telemetry_address  = flag.String("telemetry-address", "", "Address of the HTTP endpoint of the telemetry, the pool stats in JSON at /debug/vars (empty: disabled)")
+	telemetry_interval = flag.Duration("telemetry-interval", 10*time.Second, "Interval of the pool stats published to the telemetry")
+)
+
+// telemetry_pools are the last snapshots of the stats of the pools, by address, in the expvar "pools".
+var telemetry_pools = expvar.NewMap("pools")
+
+// ServeTelemetry serves the expvar variables at /debug/vars of the address, until the process ends.
+func ServeTelemetry(address string) {
+	log.Printf("Telemetry at http://%s/debug/vars\n", address)
+	if err := http.ListenAndServe(address, nil); err != nil {
+		log.Println("Telemetry:", err)
+	}
+}
+
+// poolTelemetry is the expvar of a pool, the last snapshot of its stats in JSON.
+type poolTelemetry struct {
+	mux  sync.Mutex
+	last PoolStats
+}
+
+func (t *poolTelemetry) String() string {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	data, _ := json.Marshal(t.last)
+	return string(data)
+}
+
+// PublishStats publishes the snapshots of the stats of the pool to the telemetry, until the pool is closed.
+func PublishStats(address string, pool *Pool) error {
+	if *telemetry_address == "" {
+		return nil
+	}
+	snapshots, _, err := pool.Subscribe(*telemetry_interval)
+	if err != nil {
+		return err
+	}
+	telemetry := &poolTelemetry{last: pool.Stats()}
+	telemetry_pools.Set(address, telemetry)
+	go func() {
+		for stats := range snapshots {
+			telemetry.mux.Lock()
+			telemetry.last = stats
+			telemetry.mux.Unlock()
+		}
+		// another pool to the address may have replaced it
+		if telemetry_pools.Get(address) == telemetry {
+			telemetry_pools.Delete(address)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var tenants_config = flag.String("tenants", "", "Weight and max connections of the tenants sharing the pool, name:weight[:max], e.g. \"billing:3:6,reports:1:2\"")
+
+// tenant is a user of the pool, its acquires are scheduled with its weight and limited to max connections.
+// The tenants not configured have the weight 1 and no max, they are evicted when idle.
+type tenant struct {
+	weight     float64
+	max        int32 // 0: no max
+	configured bool  // by SetTenant, never evicted
+	in_use     int32
+	waiting    int
+	last_tag   float64 // tag of its last waiter
+	stats      TenantStats
+}
+
+// admits reports whether the tenant may hold one more connection.
+func (t *tenant) admits() bool {
+	return t.max == 0 || t.in_use < t.max
+}
+
+// nextTag is the tag of a new waiter of the tenant: a tenant of weight w is served w times more often
+// than a tenant of weight 1 while both wait, and an idle tenant gets no credit for the time it did not wait.
+func (t *tenant) nextTag(virtual_time float64) float64 {
+	start := t.last_tag
+	if virtual_time > start {
+		start = virtual_time
+	}
+	t.last_tag = start + 1/t.weight
+	return t.last_tag
+}
+
+// TenantStats are the acquire statistics of a tenant, since the pool was created or the tenant was evicted.
+type TenantStats struct {
+	Weight       float64
+	Max          int32
+	InUse        int32 // connections held now
+	Waiting      int   // acquires waiting now
+	Acquires     uint64
+	Waited       uint64        // acquires that waited for a connection
+	WaitDuration time.Duration // total wait of the acquires
+	Canceled     uint64        // acquires ended by their context while waiting
+}
+
+// MeanWait is the mean wait of the acquires of the tenant.
+func (s TenantStats) MeanWait() time.Duration {
+	if s.Acquires == 0 {
+		return 0
+	}
+	return s.WaitDuration / time.Duration(s.Acquires)
+}
+
+// tenant returns the tenant of the name, created with the default weight on its first acquire. The caller holds the lock.
+func (s *acquireScheduler) tenant(name string) *tenant {
+	t, ok := s.tenants[name]
+	if !ok {
+		t = &tenant{weight: 1}
+		s.tenants[name] = t
+	}
+	return t
+}
+
+// evict removes the tenant not configured without connection nor waiter, so the tenants of short-lived names
+// (the connections of a replay) do not pile up, its stats are dropped. The caller holds the lock.
+func (s *acquireScheduler) evict(name string, t *tenant) {
+	if !t.configured && t.in_use == 0 && t.waiting == 0 {
+		delete(s.tenants, name)
+	}
+}
+
+// SetTenant sets the weight and the max connections (0: no max) of the tenant.
+func (s *acquireScheduler) SetTenant(name string, weight float64, max int32) error {
+	if weight <= 0 {
+		return fmt.Errorf("tenant %q: weight %g is not positive", name, weight)
+	}
+	if max < 0 {
+		return fmt.Errorf("tenant %q: max %d is negative", name, max)
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	t := s.tenant(name)
+	t.weight, t.max, t.configured = weight, max, true
+	s.grant()
+	return nil
+}
+
+// TenantStats returns the statistics of the tenants, by name.
+func (s *acquireScheduler) TenantStats() map[string]TenantStats {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	tenants := make(map[string]TenantStats, len(s.tenants))
+	for name, t := range s.tenants {
+		stats := t.stats
+		stats.Weight, stats.Max = t.weight, t.max
+		stats.InUse, stats.Waiting = t.in_use, t.waiting
+		tenants[name] = stats
+	}
+	return tenants
+}
+
+// TenantConfig is the weight and the max connections of a tenant.
+type TenantConfig struct {
+	Name   string
+	Weight float64
+	Max    int32
+}
+
+// ParseTenants parses the tenants, "billing:3:6,reports:1:2".
+func ParseTenants(value string) ([]TenantConfig, error) {
+	var tenants []TenantConfig
+	if value == "" {
+		return tenants, nil
+	}
+	for _, item := range strings.Split(value, ",") {
+		parts := strings.Split(strings.TrimSpace(item), ":")
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, fmt.Errorf("invalid tenant %q", item)
+		}
+		config := TenantConfig{Name: parts[0]}
+		weight, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tenant %q: %v", item, err)
+		}
+		config.Weight = weight
+		if len(parts) == 3 {
+			max, err := strconv.ParseUint(parts[2], 10, 31)
+			if err != nil {
+				return nil, fmt.Errorf("invalid tenant %q: %v", item, err)
+			}
+			config.Max = int32(max)
+		}
+		tenants = append(tenants, config)
+	}
+	return tenants, nil
+}
+
+// SetTenants configures the tenants of the pool.
+func (p *Pool) SetTenants(tenants []TenantConfig) error {
+	for _, config := range tenants {
+		if err := p.scheduler.SetTenant(config.Name, config.Weight, config.Max); err != nil {
+			return err
+		}
+	}
+	return nil
+}
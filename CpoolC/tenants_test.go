@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// waitQueued waits until n acquires are queued in the scheduler.
+func waitQueued(t *testing.T, s *acquireScheduler, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		s.mux.Lock()
+		queued := len(s.waiters[PriorityNormal])
+		s.mux.Unlock()
+		if queued == n {
+			return
+		}
+	}
+	t.Fatalf("%d acquires not queued", n)
+}
+
+func TestWeightedShare(t *testing.T) {
+	s := newAcquireScheduler(1)
+	if err := s.SetTenant("billing", 3, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Wait(context.Background(), "holder", PriorityNormal); err != nil {
+		t.Fatal(err)
+	}
+
+	admitted := make(chan string)
+	for i := 0; i < 8; i++ {
+		for _, name := range []string{"billing", "reports"} {
+			go func(name string) {
+				if err := s.Wait(context.Background(), name, PriorityNormal); err == nil {
+					admitted <- name
+				}
+			}(name)
+		}
+	}
+	waitQueued(t, s, 16)
+
+	// while both wait, billing gets three connections for one of reports
+	share := make(map[string]int)
+	s.Done("holder")
+	for i := 0; i < 8; i++ {
+		name := <-admitted
+		share[name]++
+		s.Done(name)
+	}
+	if share["billing"] != 6 || share["reports"] != 2 {
+		t.Errorf("share %v, want billing 6 and reports 2", share)
+	}
+	for i := 0; i < 8; i++ {
+		s.Done(<-admitted)
+	}
+}
+
+func TestTenantMax(t *testing.T) {
+	s := newAcquireScheduler(8)
+	if err := s.SetTenant("reports", 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := s.Wait(context.Background(), "reports", PriorityNormal); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := s.Wait(ctx, "reports", PriorityNormal); err == nil {
+		t.Error("acquire admitted above the max of the tenant")
+	}
+	// the other tenants are not blocked by the waiter at its max
+	if err := s.Wait(context.Background(), "billing", PriorityNormal); err != nil {
+		t.Error(err)
+	}
+	stats := s.TenantStats()
+	if stats["reports"].InUse != 2 || stats["reports"].Canceled != 1 || stats["billing"].InUse != 1 {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+func TestEvictTenants(t *testing.T) {
+	s := newAcquireScheduler(2)
+	if err := s.SetTenant("billing", 3, 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"billing", "connection-1"} {
+		if err := s.Wait(context.Background(), name, PriorityNormal); err != nil {
+			t.Fatal(err)
+		}
+		s.Done(name)
+	}
+	stats := s.TenantStats()
+	if _, ok := stats["connection-1"]; ok || len(stats) != 1 || stats["billing"].Weight != 3 {
+		t.Errorf("tenants %+v, want billing only", stats)
+	}
+}
+
+func TestSetTenantErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		weight float64
+		max    int32
+	}{
+		{"zero weight", 0, 1},
+		{"negative weight", -1, 1},
+		{"negative max", 1, -1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := newAcquireScheduler(8).SetTenant("billing", test.weight, test.max); err == nil {
+				t.Errorf("SetTenant(%g, %d) accepted", test.weight, test.max)
+			}
+		})
+	}
+}
+
+func TestParseTenants(t *testing.T) {
+	tenants, err := ParseTenants("billing:3:6, reports:0.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []TenantConfig{{"billing", 3, 6}, {"reports", 0.5, 0}}
+	if len(tenants) != len(want) || tenants[0] != want[0] || tenants[1] != want[1] {
+		t.Errorf("tenants %+v, want %+v", tenants, want)
+	}
+	for _, value := range []string{"billing", "billing:x", "billing:1:-2", "billing:1:2:3"} {
+		if _, err := ParseTenants(value); err == nil {
+			t.Errorf("ParseTenants(%q) accepted", value)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"common/vendordict"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+)
+
+// Timing AVPs of the test server (-timing-avps, see vendordict): the time the server received the request and sent
+// the answer, in nanoseconds since the Unix epoch. The one-way times need the clocks of the client and the server in sync.
+
+// requestTiming are the times of a request on the client.
+type requestTiming struct {
+	acquire  time.Time // the connection is requested to the pool
+	acquired time.Time
+	answered time.Time
+}
+
+// Latency is the breakdown of the latency of a request.
+type Latency struct {
+	Pool       time.Duration // waiting for a connection of the pool
+	ToServer   time.Duration // from the write of the request to its receipt by the server
+	Server     time.Duration // processing in the server
+	FromServer time.Duration // from the send of the answer to its read
+	Total      time.Duration
+	Timed      bool // the answer has the timing AVPs, else only Pool and Total are known
+}
+
+// NewLatency splits the latency of the request with the timing AVPs of its answer.
+func NewLatency(timing requestTiming, answer *diam.Message) Latency {
+	latency := Latency{
+		Pool:  timing.acquired.Sub(timing.acquire),
+		Total: timing.answered.Sub(timing.acquire),
+	}
+	received, ok_received := timestampAVP(answer, vendordict.ReceiveTimestamp)
+	sent, ok_sent := timestampAVP(answer, vendordict.SendTimestamp)
+	if !ok_received || !ok_sent {
+		return latency
+	}
+	latency.ToServer = received.Sub(timing.acquired)
+	latency.Server = sent.Sub(received)
+	latency.FromServer = timing.answered.Sub(sent)
+	latency.Timed = true
+	return latency
+}
+
+func timestampAVP(answer *diam.Message, code uint32) (time.Time, bool) {
+	a, err := answer.FindAVP(code, vendordict.VendorID)
+	if err != nil {
+		return time.Time{}, false
+	}
+	nanoseconds, ok := a.Data.(datatype.Unsigned64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(nanoseconds)), true
+}
+
+func (latency Latency) String() string {
+	if !latency.Timed {
+		return fmt.Sprintf("total %s = pool %s + round trip %s", latency.Total, latency.Pool, latency.Total-latency.Pool)
+	}
+	return fmt.Sprintf("total %s = pool %s + to server %s + server %s + from server %s",
+		latency.Total, latency.Pool, latency.ToServer, latency.Server, latency.FromServer)
+}
+
+// latencyStats sums the latencies of the requests, for the averages.
+type latencyStats struct {
+	mux   sync.Mutex
+	count int
+	timed int
+	sum   Latency
+}
+
+var latencies latencyStats
+
+func (stats *latencyStats) Add(latency Latency) {
+	stats.mux.Lock()
+	defer stats.mux.Unlock()
+	stats.count++
+	stats.sum.Pool += latency.Pool
+	stats.sum.Total += latency.Total
+	if latency.Timed {
+		stats.timed++
+		stats.sum.ToServer += latency.ToServer
+		stats.sum.Server += latency.Server
+		stats.sum.FromServer += latency.FromServer
+	}
+}
+
+// PrintLatencies prints the average latency breakdown of the requests.
+func PrintLatencies() {
+	latencies.mux.Lock()
+	defer latencies.mux.Unlock()
+	if latencies.count == 0 {
+		return
+	}
+	average := Latency{
+		Pool:  latencies.sum.Pool / time.Duration(latencies.count),
+		Total: latencies.sum.Total / time.Duration(latencies.count),
+	}
+	if latencies.timed == latencies.count {
+		average.ToServer = latencies.sum.ToServer / time.Duration(latencies.timed)
+		average.Server = latencies.sum.Server / time.Duration(latencies.timed)
+		average.FromServer = latencies.sum.FromServer / time.Duration(latencies.timed)
+		average.Timed = true
+	}
+	fmt.Printf("Average latency of %d requests: %s\n", latencies.count, average)
+}
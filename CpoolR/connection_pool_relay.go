@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+	"github.com/fiorix/go-diameter/v4/diam/dict"
+)
+
+// Diameter relay agent: the requests of the clients are forwarded to the upstream servers of their route,
+// on connections of a pool per upstream, and the answers are sent back to the clients.
+var (
+	address        = flag.String("address", "127.0.0.1:3868", "Address of the relay")
+	routes_file    = flag.String("routes", "routes.yaml", "YAML routing table of the relay")
+	origin_host    = flag.String("origin-host", "cpoolr.test", "Origin-Host of the relay")
+	origin_realm   = flag.String("origin-realm", "test", "Origin-Realm of the relay")
+	pool_size      = flag.Int("pool-size", 8, "Max number of connections to each upstream server")
+	answer_timeout = flag.Duration("answer-timeout", 5*time.Second, "Max time to wait for the answer of an upstream server")
+)
+
+var mylog = log.New(os.Stdout, "[Relay] ", log.Ldate|log.Ltime)
+
+var routing_table *RoutingTable
+
+// next_hop_by_hop is the last Hop-by-Hop ID of the forwarded requests, unique on the upstream connections
+var next_hop_by_hop = rand.Uint32()
+
+func main() {
+	flag.Parse()
+
+	var err error
+	if routing_table, err = LoadRoutingTable(*routes_file); err != nil {
+		mylog.Println(err)
+		return
+	}
+	mylog.Printf("Loaded %d routes\n", len(routing_table.Routes))
+
+	bind_address, err := net.ResolveTCPAddr("tcp", *address)
+	if err != nil {
+		mylog.Println(err)
+		return
+	}
+	server, err := net.ListenTCP("tcp", bind_address)
+	if err != nil {
+		mylog.Println(err)
+		return
+	}
+	// the listener is closed on SIGINT/SIGTERM, then the pools to the upstreams
+	defer upstreams.Close()
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		mylog.Println("Shutting down")
+		server.Close()
+	}()
+
+	mylog.Printf("Relay at %s\n", server.Addr())
+
+	connection_count := 1
+
+	for {
+		client, err := server.AcceptTCP()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			mylog.Println(err)
+			continue
+		}
+		go handleConnection(&peerConnection{Conn: client, id: uint(connection_count)})
+		connection_count++
+	}
+}
+
+// peerConnection is a client connection of the relay, the answers of the forwarded requests are written concurrently.
+type peerConnection struct {
+	net.Conn
+	id          uint
+	write_mux   sync.Mutex
+	origin_host string // learned in the CER
+}
+
+func (c *peerConnection) WriteMessage(message *diam.Message) error {
+	c.write_mux.Lock()
+	defer c.write_mux.Unlock()
+	_, err := message.WriteTo(c.Conn)
+	return err
+}
+
+func handleConnection(connection *peerConnection) {
+	mylog.Printf("Created NEW connection %s -> %s [ ID = %d ]\n", connection.LocalAddr(), connection.RemoteAddr(), connection.id)
+	defer mylog.Printf("Closed connection %s -> %s [ ID = %d ]\n", connection.LocalAddr(), connection.RemoteAddr(), connection.id)
+	defer connection.Close()
+
+	for {
+		message, err := diam.ReadMessage(connection, dict.Default)
+		if err != nil {
+			mylog.Println(err)
+			return
+		}
+		if message.Header.CommandFlags&diam.RequestFlag == 0 {
+			mylog.Printf("Dropped answer from connectionID: %d, the relay sends no request to the clients\n", connection.id)
+			continue
+		}
+
+		// the messages of the peer connection itself are not relayed
+		switch message.Header.CommandCode {
+		case diam.CapabilitiesExchange:
+			if origin, err := message.FindAVP(avp.OriginHost, 0); err == nil {
+				connection.origin_host = string(origin.Data.Serialize())
+			}
+			connection.WriteMessage(localAnswer(message, diam.Success))
+			continue
+		case diam.DeviceWatchdog:
+			connection.WriteMessage(localAnswer(message, diam.Success))
+			continue
+		case diam.DisconnectPeer:
+			connection.WriteMessage(localAnswer(message, diam.Success))
+			return
+		}
+
+		go connection.Forward(message)
+	}
+}
+
+// Forward relays the request to an upstream of its route and writes the answer to the client.
+func (c *peerConnection) Forward(request *diam.Message) {
+	start := time.Now()
+	answer, upstream := c.relay(request)
+	if answer == nil {
+		mylog.Printf("Relayed %s from connectionID: %d to %s, without answer\n", sessionID(request), c.id, upstream)
+		return
+	}
+	if err := c.WriteMessage(answer); err != nil {
+		mylog.Println(err)
+		return
+	}
+	if upstream == "" {
+		mylog.Printf("Not relayed %s from connectionID: %d, Result-Code %d\n", sessionID(request), c.id, resultCode(answer))
+		return
+	}
+	mylog.Printf("Relayed %s from connectionID: %d to %s, Result-Code %d, in %s\n",
+		sessionID(request), c.id, upstream, resultCode(answer), time.Since(start))
+}
+
+// relay forwards the request and returns the answer to the client, nil if the upstream did not answer.
+func (c *peerConnection) relay(request *diam.Message) (*diam.Message, string) {
+	route_records, _ := request.FindAVPs(avp.RouteRecord, 0)
+	for _, route_record := range route_records {
+		if string(route_record.Data.Serialize()) == *origin_host {
+			return errorAnswer(request, diam.LoopDetected), ""
+		}
+	}
+
+	route := routing_table.Match(request)
+	if route == nil {
+		return errorAnswer(request, diam.RealmNotServed), ""
+	}
+	upstream := route.Upstream()
+
+	pool, err := upstreams.Get(upstream)
+	if err != nil {
+		mylog.Println(err)
+		return errorAnswer(request, diam.UnableToDeliver), upstream
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *answer_timeout)
+	defer cancel()
+	res, err := pool.Acquire(ctx)
+	if err != nil {
+		mylog.Printf("Upstream %s: %v\n", upstream, err)
+		return errorAnswer(request, diam.UnableToDeliver), upstream
+	}
+
+	// the peer the request was received from: its identity learned in the CER, or its Origin-Host without CER
+	peer := c.origin_host
+	if peer == "" {
+		if origin, err := request.FindAVP(avp.OriginHost, 0); err == nil {
+			peer = string(origin.Data.Serialize())
+		}
+	}
+	request.NewAVP(avp.RouteRecord, avp.Mbit, 0, datatype.DiameterIdentity(peer))
+
+	// the Hop-by-Hop ID of the client is restored in the answer
+	hop_by_hop := request.Header.HopByHopID
+	request.Header.HopByHopID = atomic.AddUint32(&next_hop_by_hop, 1)
+
+	if !route.ExpectsAnswer(request) {
+		_, err := request.WriteTo(res.Value())
+		request.Header.HopByHopID = hop_by_hop
+		if err != nil {
+			mylog.Printf("Upstream %s: %v\n", upstream, err)
+			res.Destroy()
+			return errorAnswer(request, diam.UnableToDeliver), upstream
+		}
+		res.Release()
+		return nil, upstream
+	}
+
+	res.Value().SetDeadline(time.Now().Add(*answer_timeout))
+	answer, err := exchange(res.Value(), request)
+	request.Header.HopByHopID = hop_by_hop
+	if errors.Is(err, errNoAnswer) {
+		// the connection is still usable, a late answer is dropped as stale, and the client times out by itself
+		mylog.Printf("Upstream %s: %v\n", upstream, err)
+		res.Value().SetDeadline(time.Time{})
+		res.Release()
+		return nil, upstream
+	}
+	if err != nil {
+		mylog.Printf("Upstream %s: %v\n", upstream, err)
+		res.Destroy()
+		return errorAnswer(request, diam.UnableToDeliver), upstream
+	}
+	res.Value().SetDeadline(time.Time{})
+	res.Release()
+
+	answer.Header.HopByHopID = hop_by_hop
+	return answer, upstream
+}
+
+// localAnswer is the answer of the relay itself.
+func localAnswer(request *diam.Message, result_code uint32) *diam.Message {
+	answer := request.Answer(result_code)
+	answer.NewAVP(avp.OriginHost, avp.Mbit, 0, datatype.DiameterIdentity(*origin_host))
+	answer.NewAVP(avp.OriginRealm, avp.Mbit, 0, datatype.DiameterIdentity(*origin_realm))
+	if request.Header.CommandCode == diam.CapabilitiesExchange {
+		answer.NewAVP(avp.VendorID, avp.Mbit, 0, datatype.Unsigned32(0))
+		answer.NewAVP(avp.ProductName, 0, 0, datatype.UTF8String("CpoolR"))
+		answer.NewAVP(avp.AcctApplicationID, avp.Mbit, 0, relay_application_id)
+	}
+	return answer
+}
+
+// errorAnswer is a protocol error answer of the relay, with the E flag.
+func errorAnswer(request *diam.Message, result_code uint32) *diam.Message {
+	answer := localAnswer(request, result_code)
+	answer.Header.CommandFlags |= diam.ErrorFlag
+	if session_id := sessionID(request); session_id != "" {
+		answer.InsertAVP(diam.NewAVP(avp.SessionID, avp.Mbit, 0, datatype.UTF8String(session_id)))
+	}
+	return answer
+}
+
+func sessionID(message *diam.Message) string {
+	if session, err := message.FindAVP(avp.SessionID, 0); err == nil {
+		return string(session.Data.Serialize())
+	}
+	return ""
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sync/atomic"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"gopkg.in/yaml.v3"
+)
+
+// RoutingTable routes the requests by Destination-Realm and Application-Id, the first matching route is used.
+// An empty or "*" realm and a missing application_id match any request.
+//
+// The requests of a route whose Session-Id matches no_answer are not answered by the upstream,
+// they are forwarded without waiting for an answer.
+//
+//	routes:
+//	  - realm: test
+//	    application_id: 4
+//	    upstreams: [127.0.0.1:8080, 127.0.0.1:8081]
+//	  - realm: "*"
+//	    upstreams: [127.0.0.1:8080]
+//	    no_answer: "^test_send_(Multiple_)?message"
+type RoutingTable struct {
+	Routes []*Route `yaml:"routes"`
+}
+
+type Route struct {
+	Realm         string   `yaml:"realm"`
+	ApplicationID *uint32  `yaml:"application_id"`
+	Upstreams     []string `yaml:"upstreams"`
+	NoAnswer      string   `yaml:"no_answer"` // regex of the Session-Id of the requests without answer
+
+	no_answer *regexp.Regexp
+	next      uint32 // round robin between the upstreams
+}
+
+func LoadRoutingTable(file string) (*RoutingTable, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	table := &RoutingTable{}
+	if err := yaml.Unmarshal(data, table); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	for i, route := range table.Routes {
+		if len(route.Upstreams) == 0 {
+			return nil, fmt.Errorf("%s: route %d has no upstream", file, i+1)
+		}
+		if route.NoAnswer != "" {
+			if route.no_answer, err = regexp.Compile(route.NoAnswer); err != nil {
+				return nil, fmt.Errorf("%s: route %d: %v", file, i+1, err)
+			}
+		}
+	}
+	return table, nil
+}
+
+// Match returns the route of the request, nil if the realm is not served.
+func (table *RoutingTable) Match(request *diam.Message) *Route {
+	realm := ""
+	if destination, err := request.FindAVP(avp.DestinationRealm, 0); err == nil {
+		realm = string(destination.Data.Serialize())
+	}
+	for _, route := range table.Routes {
+		if route.Realm != "" && route.Realm != "*" && route.Realm != realm {
+			continue
+		}
+		if route.ApplicationID != nil && *route.ApplicationID != request.Header.ApplicationID {
+			continue
+		}
+		return route
+	}
+	return nil
+}
+
+// ExpectsAnswer reports whether the upstream answers the request.
+func (route *Route) ExpectsAnswer(request *diam.Message) bool {
+	if route.no_answer == nil {
+		return true
+	}
+	session, err := request.FindAVP(avp.SessionID, 0)
+	return err != nil || !route.no_answer.MatchString(string(session.Data.Serialize()))
+}
+
+// Upstream returns the next upstream of the route.
+func (route *Route) Upstream() string {
+	n := atomic.AddUint32(&route.next, 1)
+	return route.Upstreams[(n-1)%uint32(len(route.Upstreams))]
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+	"github.com/fiorix/go-diameter/v4/diam/dict"
+	"github.com/jackc/puddle/v2"
+)
+
+// relay application, advertised in the CER of the upstream connections
+const relay_application_id = datatype.Unsigned32(0xffffffff)
+
+// upstreamPools are the connection pools to the upstream servers, by address.
+type upstreamPools struct {
+	mux   sync.Mutex
+	pools map[string]*puddle.Pool[net.Conn]
+}
+
+var upstreams = &upstreamPools{pools: make(map[string]*puddle.Pool[net.Conn])}
+
+// Get returns the pool to the upstream, it is created on the first request routed to it.
+func (p *upstreamPools) Get(address string) (*puddle.Pool[net.Conn], error) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	if pool, ok := p.pools[address]; ok {
+		return pool, nil
+	}
+	pool, err := puddle.NewPool(
+		&puddle.Config[net.Conn]{
+			Constructor: func(ctx context.Context) (net.Conn, error) { return CreateUpstreamConnection(ctx, address) },
+			Destructor:  func(connection net.Conn) { connection.Close() },
+			MaxSize:     int32(*pool_size),
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	p.pools[address] = pool
+	mylog.Printf("Created pool to upstream %s\n", address)
+	return pool, nil
+}
+
+func (p *upstreamPools) Close() {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	for address, pool := range p.pools {
+		pool.Close()
+		delete(p.pools, address)
+	}
+}
+
+// CreateUpstreamConnection connects to the upstream and exchanges the capabilities.
+func CreateUpstreamConnection(ctx context.Context, address string) (net.Conn, error) {
+	var dialer net.Dialer
+	connection, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	cer := diam.NewRequest(diam.CapabilitiesExchange, 0, nil)
+	cer.NewAVP(avp.OriginHost, avp.Mbit, 0, datatype.DiameterIdentity(*origin_host))
+	cer.NewAVP(avp.OriginRealm, avp.Mbit, 0, datatype.DiameterIdentity(*origin_realm))
+	if local, ok := connection.LocalAddr().(*net.TCPAddr); ok {
+		cer.NewAVP(avp.HostIPAddress, avp.Mbit, 0, datatype.Address(local.IP.To4()))
+	}
+	cer.NewAVP(avp.VendorID, avp.Mbit, 0, datatype.Unsigned32(0))
+	cer.NewAVP(avp.ProductName, 0, 0, datatype.UTF8String("CpoolR"))
+	cer.NewAVP(avp.AcctApplicationID, avp.Mbit, 0, relay_application_id)
+
+	connection.SetDeadline(time.Now().Add(*answer_timeout))
+	defer connection.SetDeadline(time.Time{})
+
+	cea, err := exchange(connection, cer)
+	if err != nil {
+		connection.Close()
+		return nil, fmt.Errorf("CER to %s: %v", address, err)
+	}
+	if result := resultCode(cea); result != diam.Success {
+		connection.Close()
+		return nil, fmt.Errorf("CER to %s: Result-Code %d", address, result)
+	}
+	return connection, nil
+}
+
+// errNoAnswer is returned by exchange when the deadline is reached between two messages: the connection is still usable.
+var errNoAnswer = errors.New("no answer before the deadline")
+
+// countingReader counts the bytes read, to know whether a deadline interrupted a message.
+type countingReader struct {
+	reader io.Reader
+	n      int
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.reader.Read(b)
+	r.n += n
+	return n, err
+}
+
+// exchange sends the request on the connection and reads its answer, by Hop-by-Hop ID.
+// The requests of the upstream can not be relayed back, they are answered with DIAMETER_UNABLE_TO_DELIVER.
+func exchange(connection net.Conn, request *diam.Message) (*diam.Message, error) {
+	if _, err := request.WriteTo(connection); err != nil {
+		return nil, err
+	}
+	for {
+		reader := &countingReader{reader: connection}
+		message, err := diam.ReadMessage(reader, dict.Default)
+		var net_err net.Error
+		if errors.As(err, &net_err) && net_err.Timeout() && reader.n == 0 {
+			return nil, errNoAnswer
+		} else if err != nil {
+			return nil, err
+		}
+		if message.Header.CommandFlags&diam.RequestFlag != 0 {
+			answer := errorAnswer(message, diam.UnableToDeliver)
+			if _, err := answer.WriteTo(connection); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if message.Header.HopByHopID != request.Header.HopByHopID {
+			mylog.Printf("Dropped stale answer, Hop-by-Hop ID %#x\n", message.Header.HopByHopID)
+			continue
+		}
+		return message, nil
+	}
+}
+
+func resultCode(answer *diam.Message) uint32 {
+	if result, err := answer.FindAVP(avp.ResultCode, 0); err == nil {
+		if value, ok := result.Data.(datatype.Unsigned32); ok {
+			return uint32(value)
+		}
+	}
+	return 0
+}
@@ -1,17 +1,28 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"net"
 	"time"
 
+	"common/admit"
+
 	"github.com/fiorix/go-diameter/v4/diam"
 	"github.com/fiorix/go-diameter/v4/diam/avp"
 	"github.com/fiorix/go-diameter/v4/diam/datatype"
 	"github.com/fiorix/go-diameter/v4/diam/dict"
 )
 
+// admission control, to benchmark how the client pool reacts to overload (see common/admit)
+var admission_config = admit.RegisterFlags()
+
+var admission *admit.Control
+
 func main() {
+	flag.Parse()
+	admission = admit.New(*admission_config)
+
 	bind_address, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:8080")
 	server, err := net.ListenTCP("tcp", bind_address)
 	if err != nil {
@@ -21,6 +32,15 @@ func main() {
 
 	fmt.Printf("Serve at %s\n", server.Addr())
 
+	if admission.Enabled() {
+		go func() {
+			for {
+				fmt.Println(admission)
+				time.Sleep(time.Second)
+			}
+		}()
+	}
+
 	connection_count := 1
 
 	for {
@@ -29,6 +49,11 @@ func main() {
 			fmt.Println(err)
 			continue
 		}
+		if !admission.AcceptConnection() {
+			fmt.Printf("Rejected connection %s, max connections (%d) reached\n", client.RemoteAddr(), admission.MaxConnections())
+			client.Close()
+			continue
+		}
 		go handleConnection(client, uint(connection_count))
 		connection_count++
 	}
@@ -37,6 +62,9 @@ func main() {
 
 func handleConnection(connection net.Conn, connectionID uint) {
 	fmt.Printf("\nCreated NEW connection %s -> %s [ ID = %d ]\n\n", connection.LocalAddr(), connection.RemoteAddr(), connectionID)
+	defer admission.ReleaseConnection()
+
+	connection_limit := admission.NewConnectionLimit()
 
 	for {
 		request, err := diam.ReadMessage(connection, dict.Default)
@@ -50,6 +78,13 @@ func handleConnection(connection net.Conn, connectionID uint) {
 		fmt.Printf(" message: %s, from connectionID: %d\n", request.String(), connectionID)
 		fmt.Println("______________________________________________________________")
 
+		if !admission.AdmitRequest(connection_limit) {
+			response := admit.TooBusyAnswer(request)
+			response.WriteTo(connection)
+			fmt.Printf("Too busy, rejected message from connectionID: %d\n", connectionID)
+			continue
+		}
+
 		msg := diam.NewRequest(diam.Accounting, 0, nil)
 		msg.Header.CommandFlags = 0
 		sessionID := datatype.UTF8String(fmt.Sprintf("0k 200, id=%d", connectionID))
@@ -57,6 +92,7 @@ func handleConnection(connection net.Conn, connectionID uint) {
 
 		// Send response to client
 		msg.WriteTo(connection)
+		admission.DoneRequest()
 
 		time.Sleep(100 * time.Microsecond)
 	}
@@ -10,27 +10,20 @@ import (
 	"sync"
 	"time"
 
+	"common/dialer"
+	"common/inbound"
+
 	MQTT "github.com/eclipse/paho.mqtt.golang"
 	"github.com/fiorix/go-diameter/v4/diam"
 	"github.com/fiorix/go-diameter/v4/diam/avp"
 	"github.com/fiorix/go-diameter/v4/diam/datatype"
-	"github.com/fiorix/go-diameter/v4/diam/dict"
 	MyPool "github.com/tangnguyendeveloper/ConnectionPool/pool"
 )
 
 var pool *MyPool.ConnectionPool
 
-type myKeyType int
-
 var mylog = log.New(os.Stdout, "[ClientTest] ", log.Ldate|log.Ltime)
 
-const (
-	addr_key myKeyType = iota
-
-	// in seconds
-	keep_alive_period_key myKeyType = iota
-)
-
 var mux sync.Mutex
 var sent_count uint32 = 0
 
@@ -42,23 +35,31 @@ func main() {
 
 	numCPU = runtime.NumCPU()
 
+	// Answer the requests of the server read on the connections of the pool
+	inbound.Handle(diam.ReAuth, inbound.AnswerSuccess)
+	inbound.Handle(diam.AbortSession, inbound.AnswerSuccess)
+
+	// Transport of the connections, see the common/dialer package for Unix domain socket, TLS and proxies
+	transport := &dialer.TCPDialer{
+		Address:   "tcp-cpools-service:8080",
+		Timeout:   5 * time.Second,  // Max time to connect
+		KeepAlive: 30 * time.Second, // Period of the TCP keepalive
+	}
+
 	// Create the pool
 	pool = MyPool.NewConnectionPool(
 		&MyPool.Config{
 			MaxResource:       uint64(numCPU) * 16, // Max connection of the pool
 			MinIdleResource:   8,                   // Min idle connection of the pool
-			Constructor:       CreateNewConnection, // Function to create new connection
+			Constructor:       transport.Dial,      // Function to create new connection
 			Destructor:        CloseConnection,     // Function to close connection
 			ReconnectInterval: 5,                   // Time interval to reconnect if the connection of the pool are lost (in seconds)
 			IdleKeepAlive:     120,                 // The time duration to remove the connection of the pool if that connection is not use (in seconds)
 		})
 
-	server_address, _ := net.ResolveTCPAddr("tcp", "tcp-cpools-service:8080")
-	// configure of connection
 	// connection_config_ctx is the Context Object, this variable can be used to manage life cycle
-	connection_config_ctx := context.WithValue(context.Background(), addr_key, server_address)
-	connection_config_ctx = context.WithValue(connection_config_ctx, keep_alive_period_key, time.Duration(30))
 	// connection_config_ctx can use to close the pool (optional)
+	connection_config_ctx := context.Background()
 	go pool.Start(connection_config_ctx)
 
 	time.Sleep(3 * time.Second)
@@ -112,25 +113,14 @@ func main() {
 
 }
 
-func CreateNewConnection(ctx context.Context) (net.Conn, error) {
-	server_address := ctx.Value(addr_key).(*net.TCPAddr)
-	keep_alive_period := ctx.Value(keep_alive_period_key).(time.Duration)
-	connection, err := net.DialTCP("tcp", nil, server_address)
-	if err == nil {
-		connection.SetKeepAlive(true)
-		connection.SetKeepAlivePeriod(keep_alive_period * time.Second)
-	}
-	return connection, err
-}
-
 func CloseConnection(value net.Conn) { value.Close() }
 
-func encapsulation_message(mess datatype.UTF8String, id datatype.Unsigned32) ([]byte, error) {
+func encapsulation_message(mess datatype.UTF8String, id datatype.Unsigned32) *diam.Message {
 	msg := diam.NewRequest(diam.Accounting, 0, nil)
 	sessionID := mess
 	msg.NewAVP(avp.SessionID, avp.Mbit, 0, sessionID)
 	msg.NewAVP(avp.AcctInterimInterval, avp.Mbit, 0, id)
-	return msg.Serialize()
+	return msg
 }
 
 func RunTest(n int) {
@@ -151,26 +141,14 @@ func TestSendRequest(test_n uint32) {
 
 	defer wg.Done()
 
-	request, err := encapsulation_message(datatype.UTF8String("test_request_message"), datatype.Unsigned32(test_n))
-	if err != nil {
-		mylog.Println(err)
-	}
+	request := encapsulation_message(datatype.UTF8String("test_request_message"), datatype.Unsigned32(test_n))
 
-	resource, err := pool.SendRequest(request)
-	if err != nil {
-		mylog.Println(err)
-		return
-	}
-	//mylog.Println("SendRequest")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 
-	_, err = diam.ReadMessage(resource.Value().(*net.TCPConn), dict.Default)
+	_, err := Exchange(ctx, request)
 	if err != nil {
 		mylog.Println(err)
-		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-			resource.Release()
-			return
-		}
-		resource.Destroy()
 		return
 	}
 
@@ -180,8 +158,6 @@ func TestSendRequest(test_n uint32) {
 	sent_count++
 	mux.Unlock()
 
-	resource.Release()
-
 }
 
 // func PoolInfo() {
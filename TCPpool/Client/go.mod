@@ -3,6 +3,7 @@ module TCPpool
 go 1.17
 
 require (
+	common v0.0.0
 	github.com/eclipse/paho.mqtt.golang v1.4.3
 	github.com/fiorix/go-diameter/v4 v4.0.4
 	github.com/tangnguyendeveloper/ConnectionPool v1.0.1
@@ -14,3 +15,5 @@ require (
 	golang.org/x/net v0.8.0 // indirect
 	golang.org/x/sync v0.1.0 // indirect
 )
+
+replace common => ../../common
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"net"
@@ -8,6 +9,9 @@ import (
 	"sync"
 	"time"
 
+	"common/admit"
+	"common/reuseport"
+
 	MQTT "github.com/eclipse/paho.mqtt.golang"
 	"github.com/fiorix/go-diameter/v4/diam"
 	"github.com/fiorix/go-diameter/v4/diam/avp"
@@ -23,15 +27,27 @@ var mqtt_client MQTT.Client
 
 const topic = "sensor/benchmark"
 
+// admission control, to benchmark how the client pool reacts to overload (see common/admit)
+var admission_config = admit.RegisterFlags()
+
+var admission *admit.Control
+
+var num_listeners = flag.Int("listeners", 1, "Number of listeners on the port, with SO_REUSEPORT when more than 1, each with its own accept loop")
+
 func main() {
+	flag.Parse()
+	admission = admit.New(*admission_config)
+
 	bind_address, _ := net.ResolveTCPAddr("tcp", ":8080")
-	server, err := net.ListenTCP("tcp", bind_address)
+	listeners, err := reuseport.Listen(bind_address, *num_listeners)
 	if err != nil {
 		mylog.Println(err)
 		return
 	}
 
-	mylog.Printf("Serve at %s\n", server.Addr())
+	for i, server := range listeners {
+		mylog.Printf("Serve at %s [ listener %d ]\n", server.Addr(), i+1)
+	}
 
 	// using MQTT for publish Number connection
 
@@ -60,22 +76,18 @@ func main() {
 		mylog.Fatalf("MQTT connect %s\n", token.Error())
 	}
 
-	go func() {
+	for _, server := range listeners {
+		go acceptConnections(server)
+	}
 
-		for {
-			client, err := server.AcceptTCP()
-			if err != nil {
-				mylog.Println(err)
-				continue
+	if admission.Enabled() {
+		go func() {
+			for {
+				mylog.Println(admission)
+				time.Sleep(time.Second)
 			}
-			go handleConnection(client)
-			mux.Lock()
-			connection_count++
-			publish()
-			mux.Unlock()
-		}
-
-	}()
+		}()
+	}
 
 	for {
 		time.Sleep(2 * time.Minute)
@@ -84,6 +96,27 @@ func main() {
 
 }
 
+// acceptConnections is the accept loop of a listener.
+func acceptConnections(server *net.TCPListener) {
+	for {
+		client, err := server.AcceptTCP()
+		if err != nil {
+			mylog.Println(err)
+			continue
+		}
+		if !admission.AcceptConnection() {
+			mylog.Printf("Rejected connection %s, max connections (%d) reached\n", client.RemoteAddr(), admission.MaxConnections())
+			client.Close()
+			continue
+		}
+		go handleConnection(client)
+		mux.Lock()
+		connection_count++
+		publish()
+		mux.Unlock()
+	}
+}
+
 func publish() {
 	if token := mqtt_client.Publish(topic, 0, false, fmt.Sprintf(`{"NumConnection": %d}`, connection_count)); token.Wait() && token.Error() != nil {
 		mylog.Printf("ERROR: MQTT Publish %s\n", token.Error())
@@ -91,6 +124,9 @@ func publish() {
 }
 
 func handleConnection(connection net.Conn) {
+	defer admission.ReleaseConnection()
+
+	connection_limit := admission.NewConnectionLimit()
 
 	for {
 		request, err := diam.ReadMessage(connection, dict.Default)
@@ -110,8 +146,14 @@ func handleConnection(connection net.Conn) {
 				mylog.Println(err)
 				continue
 			}
+			if !admission.AdmitRequest(connection_limit) {
+				response := admit.TooBusyAnswer(request)
+				response.WriteTo(connection)
+				continue
+			}
 			response := request.Answer(200)
 			response.WriteTo(connection)
+			admission.DoneRequest()
 
 		}
 
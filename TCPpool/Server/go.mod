@@ -3,6 +3,7 @@ module TCPpool
 go 1.17
 
 require (
+	common v0.0.0
 	github.com/eclipse/paho.mqtt.golang v1.4.3
 	github.com/fiorix/go-diameter/v4 v4.0.4
 )
@@ -12,4 +13,7 @@ require (
 	github.com/ishidawataru/sctp v0.0.0-20190922091402-408ec287e38c // indirect
 	golang.org/x/net v0.8.0 // indirect
 	golang.org/x/sync v0.1.0 // indirect
+	golang.org/x/sys v0.13.0 // indirect
 )
+
+replace common => ../../common
@@ -0,0 +1,158 @@
+// Package admit is the admission control of the test servers, used to benchmark how the client pool reacts to overload:
+// a max number of connections, per-connection and global token-bucket rate limits, and a queue-depth threshold
+// above which the requests are answered DIAMETER_TOO_BUSY. A value of 0 disables the corresponding limit.
+package admit
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+)
+
+type Config struct {
+	MaxConnections  int     // max concurrent client connections, new connections above it are closed
+	ConnectionRate  float64 // max requests per second on each connection
+	ConnectionBurst int     // burst size of the per-connection rate limit (default: ConnectionRate)
+	GlobalRate      float64 // max requests per second of the whole server
+	GlobalBurst     int     // burst size of the global rate limit (default: GlobalRate)
+	BusyQueueDepth  int     // number of requests in process above which the server answers DIAMETER_TOO_BUSY
+}
+
+// RegisterFlags registers the flags of the admission control on the command line, the config is set by flag.Parse.
+func RegisterFlags() *Config {
+	config := &Config{}
+	flag.IntVar(&config.MaxConnections, "max-connections", 0, "Max number of concurrent client connections, new connections above it are closed")
+	flag.Float64Var(&config.ConnectionRate, "connection-rate", 0, "Max requests per second on each connection")
+	flag.IntVar(&config.ConnectionBurst, "connection-burst", 0, "Burst size of the per-connection rate limit (default: connection-rate)")
+	flag.Float64Var(&config.GlobalRate, "global-rate", 0, "Max requests per second of the whole server")
+	flag.IntVar(&config.GlobalBurst, "global-burst", 0, "Burst size of the global rate limit (default: global-rate)")
+	flag.IntVar(&config.BusyQueueDepth, "busy-queue-depth", 0, "Number of requests in process above which the server answers DIAMETER_TOO_BUSY")
+	return config
+}
+
+// TokenBucket is a token bucket rate limiter, a nil *TokenBucket allows everything.
+type TokenBucket struct {
+	mux    sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = int(math.Ceil(rate))
+	}
+	return &TokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Allow takes one token from the bucket, it returns false if the bucket is empty.
+func (bucket *TokenBucket) Allow() bool {
+	if bucket == nil {
+		return true
+	}
+
+	bucket.mux.Lock()
+	defer bucket.mux.Unlock()
+
+	now := time.Now()
+	bucket.tokens = math.Min(bucket.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*bucket.rate)
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+type Control struct {
+	config       Config
+	connections  int64 // current number of connections
+	queue_depth  int64 // current number of requests in process
+	global_limit *TokenBucket
+
+	// counters, for the stats
+	rejected_connections uint64
+	too_busy_answers     uint64
+}
+
+func New(config Config) *Control {
+	return &Control{config: config, global_limit: NewTokenBucket(config.GlobalRate, config.GlobalBurst)}
+}
+
+// Enabled reports whether any admission limit is configured.
+func (control *Control) Enabled() bool {
+	config := control.config
+	return config.MaxConnections > 0 || config.ConnectionRate > 0 || config.GlobalRate > 0 || config.BusyQueueDepth > 0
+}
+
+func (control *Control) MaxConnections() int {
+	return control.config.MaxConnections
+}
+
+// AcceptConnection reserves a connection slot, the caller must call ReleaseConnection when the connection is closed.
+func (control *Control) AcceptConnection() bool {
+	n := atomic.AddInt64(&control.connections, 1)
+	if control.config.MaxConnections > 0 && n > int64(control.config.MaxConnections) {
+		atomic.AddInt64(&control.connections, -1)
+		atomic.AddUint64(&control.rejected_connections, 1)
+		return false
+	}
+	return true
+}
+
+func (control *Control) ReleaseConnection() {
+	atomic.AddInt64(&control.connections, -1)
+}
+
+// NewConnectionLimit returns the rate limiter of a new connection.
+func (control *Control) NewConnectionLimit() *TokenBucket {
+	return NewTokenBucket(control.config.ConnectionRate, control.config.ConnectionBurst)
+}
+
+// AdmitRequest enters a request in the processing queue. It returns false when the server is too busy
+// (queue depth above the threshold or a rate limit reached), the request must then be answered with DIAMETER_TOO_BUSY.
+// If it returns true, the caller must call DoneRequest when the request is processed.
+func (control *Control) AdmitRequest(connection_limit *TokenBucket) bool {
+	n := atomic.AddInt64(&control.queue_depth, 1)
+	if (control.config.BusyQueueDepth > 0 && n > int64(control.config.BusyQueueDepth)) || !connection_limit.Allow() || !control.global_limit.Allow() {
+		atomic.AddInt64(&control.queue_depth, -1)
+		atomic.AddUint64(&control.too_busy_answers, 1)
+		return false
+	}
+	return true
+}
+
+// TooBusyAnswer is the DIAMETER_TOO_BUSY answer to a request not admitted, with the error bit of the protocol errors.
+func TooBusyAnswer(request *diam.Message) *diam.Message {
+	response := request.Answer(diam.TooBusy)
+	response.Header.CommandFlags |= diam.ErrorFlag
+	return response
+}
+
+func (control *Control) DoneRequest() {
+	atomic.AddInt64(&control.queue_depth, -1)
+}
+
+// String is the state of the admission control, printed by the servers.
+func (control *Control) String() string {
+	return fmt.Sprintf("connections: %d, queue depth: %d, rejected connections: %d, too busy answers: %d",
+		atomic.LoadInt64(&control.connections),
+		atomic.LoadInt64(&control.queue_depth),
+		atomic.LoadUint64(&control.rejected_connections),
+		atomic.LoadUint64(&control.too_busy_answers))
+}
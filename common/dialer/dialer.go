@@ -0,0 +1,275 @@
+// Package dialer opens the connections of the client pools to the server: over TCP, a Unix domain socket, TLS,
+// or through an HTTP CONNECT or SOCKS5 proxy.
+package dialer
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Dialer opens the connections of the pool, its Dial method is the Constructor of the pool.
+type Dialer interface {
+	Dial(ctx context.Context) (net.Conn, error)
+}
+
+// TCPDialer connects to Address over TCP.
+type TCPDialer struct {
+	Address   string
+	Timeout   time.Duration // max time to connect, 0: only the context
+	KeepAlive time.Duration // period of the TCP keepalive, 0: 15s, negative: disabled
+	LocalAddr *net.TCPAddr  // nil: chosen by the system
+}
+
+func (d *TCPDialer) Dial(ctx context.Context) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: d.Timeout, KeepAlive: d.KeepAlive}
+	if d.LocalAddr != nil {
+		dialer.LocalAddr = d.LocalAddr
+	}
+	return dialer.DialContext(ctx, "tcp", d.Address)
+}
+
+// UnixDialer connects to the Unix domain socket Path.
+type UnixDialer struct {
+	Path    string
+	Timeout time.Duration // max time to connect, 0: only the context
+}
+
+func (d *UnixDialer) Dial(ctx context.Context) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: d.Timeout}
+	return dialer.DialContext(ctx, "unix", d.Path)
+}
+
+// TLSDialer connects over TCP and makes the TLS handshake, within the Timeout of the TCPDialer.
+type TLSDialer struct {
+	TCPDialer
+	Config *tls.Config // nil: default, the ServerName is the host of Address if not set
+}
+
+func (d *TLSDialer) Dial(ctx context.Context) (net.Conn, error) {
+	ctx, cancel := withTimeout(ctx, d.Timeout)
+	defer cancel()
+
+	connection, err := d.TCPDialer.Dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{}
+	if d.Config != nil {
+		config = d.Config.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(d.Address)
+	}
+	tls_connection := tls.Client(connection, config)
+	if err := tls_connection.HandshakeContext(ctx); err != nil {
+		connection.Close()
+		return nil, err
+	}
+	return tls_connection, nil
+}
+
+// HTTPConnectDialer connects to Target through the HTTP proxy at the Address of the TCPDialer, with the CONNECT method.
+type HTTPConnectDialer struct {
+	TCPDialer
+	Target   string
+	Username string // Proxy-Authorization basic, if not empty
+	Password string
+}
+
+func (d *HTTPConnectDialer) Dial(ctx context.Context) (net.Conn, error) {
+	ctx, cancel := withTimeout(ctx, d.Timeout)
+	defer cancel()
+
+	connection, err := d.TCPDialer.Dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.connect(ctx, connection); err != nil {
+		connection.Close()
+		return nil, fmt.Errorf("HTTP proxy %s: %v", d.Address, err)
+	}
+	return connection, nil
+}
+
+func (d *HTTPConnectDialer) connect(ctx context.Context, connection net.Conn) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		connection.SetDeadline(deadline)
+		defer connection.SetDeadline(time.Time{})
+	}
+
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: d.Target},
+		Host:   d.Target,
+		Header: make(http.Header),
+	}
+	if d.Username != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(d.Username + ":" + d.Password))
+		request.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := request.Write(connection); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(connection)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("CONNECT %s: %s", d.Target, response.Status)
+	}
+	// the server of a Diameter connection does not speak first
+	if reader.Buffered() > 0 {
+		return errors.New("unexpected data after the CONNECT response")
+	}
+	return nil
+}
+
+// SOCKS5Dialer connects to Target through the SOCKS5 proxy (RFC 1928) at the Address of the TCPDialer.
+type SOCKS5Dialer struct {
+	TCPDialer
+	Target   string
+	Username string // username/password authentication (RFC 1929), if not empty
+	Password string
+}
+
+// SOCKS5 protocol values
+const (
+	socks5_version       = 5
+	socks5_no_auth       = 0
+	socks5_password_auth = 2
+	socks5_no_method     = 0xff
+	socks5_connect       = 1
+	socks5_ipv4          = 1
+	socks5_domain        = 3
+	socks5_ipv6          = 4
+)
+
+func (d *SOCKS5Dialer) Dial(ctx context.Context) (net.Conn, error) {
+	ctx, cancel := withTimeout(ctx, d.Timeout)
+	defer cancel()
+
+	connection, err := d.TCPDialer.Dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.connect(ctx, connection); err != nil {
+		connection.Close()
+		return nil, fmt.Errorf("SOCKS5 proxy %s: %v", d.Address, err)
+	}
+	return connection, nil
+}
+
+func (d *SOCKS5Dialer) connect(ctx context.Context, connection net.Conn) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		connection.SetDeadline(deadline)
+		defer connection.SetDeadline(time.Time{})
+	}
+
+	method := byte(socks5_no_auth)
+	if d.Username != "" {
+		method = socks5_password_auth
+	}
+	if _, err := connection.Write([]byte{socks5_version, 1, method}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(connection, reply); err != nil {
+		return err
+	}
+	if reply[0] != socks5_version || reply[1] == socks5_no_method || reply[1] != method {
+		return errors.New("no acceptable authentication method")
+	}
+
+	if method == socks5_password_auth {
+		if len(d.Username) > 255 || len(d.Password) > 255 {
+			return errors.New("username or password too long")
+		}
+		auth := []byte{1, byte(len(d.Username))}
+		auth = append(auth, d.Username...)
+		auth = append(auth, byte(len(d.Password)))
+		auth = append(auth, d.Password...)
+		if _, err := connection.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(connection, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return errors.New("authentication failed")
+		}
+	}
+
+	host, port, err := net.SplitHostPort(d.Target)
+	if err != nil {
+		return err
+	}
+	port_number, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return err
+	}
+	request := []byte{socks5_version, socks5_connect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.New("host name too long")
+		}
+		request = append(request, socks5_domain, byte(len(host)))
+		request = append(request, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		request = append(request, socks5_ipv4)
+		request = append(request, ip4...)
+	} else {
+		request = append(request, socks5_ipv6)
+		request = append(request, ip.To16()...)
+	}
+	request = append(request, byte(port_number>>8), byte(port_number))
+	if _, err := connection.Write(request); err != nil {
+		return err
+	}
+
+	// version, reply, reserved, address type, then the bound address and port
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(connection, header); err != nil {
+		return err
+	}
+	if header[1] != 0 {
+		return fmt.Errorf("CONNECT %s failed, reply %d", d.Target, header[1])
+	}
+	var address_length int
+	switch header[3] {
+	case socks5_ipv4:
+		address_length = net.IPv4len
+	case socks5_ipv6:
+		address_length = net.IPv6len
+	case socks5_domain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(connection, length); err != nil {
+			return err
+		}
+		address_length = int(length[0])
+	default:
+		return fmt.Errorf("unknown address type %d", header[3])
+	}
+	_, err = io.ReadFull(connection, make([]byte, address_length+2))
+	return err
+}
+
+// withTimeout bounds the context with the timeout, if any.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
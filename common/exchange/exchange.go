@@ -0,0 +1,68 @@
+// Package exchange reads the answer of a request written on a connection of a client pool, within a context,
+// shared by the clients of the MyPool connection pool.
+package exchange
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"common/inbound"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+)
+
+// ReadAnswer reads the answer of the request written on the connection. The server-initiated requests read before
+// the answer are served by their handler (see inbound.Handle). When the context is done the read is interrupted
+// and the error of the context is returned: the connection must be destroyed on any error, so an answer arriving
+// late never stays in its stream.
+func ReadAnswer(ctx context.Context, connection net.Conn, request *diam.Message) (*diam.Message, error) {
+	stop := WatchContext(ctx, connection)
+	answer, err := inbound.ReadAnswer(connection, request.Header.HopByHopID)
+	stop()
+
+	if err == nil {
+		err = checkAnswer(request, answer)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return answer, nil
+}
+
+// WatchContext interrupts the reads of the connection when the context is done, until stop is called.
+// stop clears the read deadline.
+func WatchContext(ctx context.Context, connection net.Conn) (stop func()) {
+	if deadline, ok := ctx.Deadline(); ok {
+		connection.SetReadDeadline(deadline)
+	}
+	read_done := make(chan struct{})
+	watch_done := make(chan struct{})
+	go func() {
+		defer close(watch_done)
+		select {
+		case <-ctx.Done():
+			connection.SetReadDeadline(time.Unix(1, 0))
+		case <-read_done:
+		}
+	}()
+	return func() {
+		close(read_done)
+		<-watch_done
+		connection.SetReadDeadline(time.Time{})
+	}
+}
+
+// checkAnswer verifies that the answer with the Hop-by-Hop ID of the request is its answer.
+func checkAnswer(request, answer *diam.Message) error {
+	if answer.Header.CommandCode != request.Header.CommandCode ||
+		answer.Header.EndToEndID != request.Header.EndToEndID {
+		return fmt.Errorf("unexpected answer, command code %d, Hop-by-Hop ID %#x, End-to-End ID %#x",
+			answer.Header.CommandCode, answer.Header.HopByHopID, answer.Header.EndToEndID)
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+module common
+
+go 1.17
+
+require (
+	github.com/fiorix/go-diameter/v4 v4.0.4
+	golang.org/x/sys v0.13.0
+)
+
+require (
+	github.com/ishidawataru/sctp v0.0.0-20190922091402-408ec287e38c // indirect
+	golang.org/x/net v0.0.0-20191007182048-72f939374954 // indirect
+)
@@ -0,0 +1,158 @@
+// Package inbound serves the requests sent by the server (Re-Auth-Request, Abort-Session-Request, ...) on the
+// connections of the client pools: they arrive on the stream of a connection while the client reads an answer,
+// or while the connection is idle.
+package inbound
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+	"github.com/fiorix/go-diameter/v4/diam/dict"
+)
+
+// RequestHandler answers a request sent by the server (Re-Auth-Request, Abort-Session-Request, ...) on a connection of the pool.
+// A nil answer is not sent.
+type RequestHandler func(request *diam.Message) *diam.Message
+
+var (
+	handlers_mux     sync.RWMutex
+	request_handlers = map[uint32]RequestHandler{ // by command code
+		diam.DeviceWatchdog: answerDeviceWatchdog,
+		diam.DisconnectPeer: answerDisconnectPeer,
+	}
+)
+
+// ErrDisconnectPeer is returned by CheckIdleConnection when the server sent a Disconnect-Peer-Request:
+// the connection must not be used anymore, the server closes it.
+var ErrDisconnectPeer = errors.New("disconnect peer requested by the server")
+
+// answerDeviceWatchdog answers the Device-Watchdog-Request sent by a server on an idle connection.
+func answerDeviceWatchdog(request *diam.Message) *diam.Message {
+	return request.Answer(diam.Success)
+}
+
+// answerDisconnectPeer answers the Disconnect-Peer-Request of a server, sent when it restarts or shuts down.
+func answerDisconnectPeer(request *diam.Message) *diam.Message {
+	log.Println("Server request, Disconnect-Peer-Request")
+	return request.Answer(diam.Success)
+}
+
+// Handle registers the handler of the server-initiated requests with this command code,
+// it replaces the default handlers of the Device-Watchdog-Request and the Disconnect-Peer-Request.
+func Handle(command_code uint32, handler RequestHandler) {
+	handlers_mux.Lock()
+	defer handlers_mux.Unlock()
+	request_handlers[command_code] = handler
+}
+
+// Serve answers a server-initiated request with its handler, or with DIAMETER_COMMAND_UNSUPPORTED.
+func Serve(connection net.Conn, request *diam.Message) error {
+	handlers_mux.RLock()
+	handler, ok := request_handlers[request.Header.CommandCode]
+	handlers_mux.RUnlock()
+
+	var answer *diam.Message
+	if ok {
+		answer = handler(request)
+	} else {
+		log.Printf("No handler of the server request, command code %d\n", request.Header.CommandCode)
+		answer = request.Answer(diam.CommandUnsupported)
+		answer.Header.CommandFlags |= diam.ErrorFlag
+	}
+	if answer == nil {
+		return nil
+	}
+	_, err := answer.WriteTo(connection)
+	return err
+}
+
+// ReadAnswer reads the connection until the answer with this Hop-by-Hop ID.
+// The server-initiated requests read meanwhile are served by their handler, and the stale answers
+// (of requests that timed out before) are dropped.
+func ReadAnswer(connection net.Conn, hop_by_hop uint32) (*diam.Message, error) {
+	for {
+		message, err := diam.ReadMessage(connection, dict.Default)
+		if err != nil {
+			return nil, err
+		}
+
+		if message.Header.CommandFlags&diam.RequestFlag != 0 {
+			if err := Serve(connection, message); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if message.Header.HopByHopID != hop_by_hop {
+			log.Printf("Dropped stale answer, Hop-by-Hop ID %#x\n", message.Header.HopByHopID)
+			continue
+		}
+		return message, nil
+	}
+}
+
+// countingReader counts the bytes read, to know whether a timeout interrupted a message.
+type countingReader struct {
+	reader io.Reader
+	n      int
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.reader.Read(b)
+	r.n += n
+	return n, err
+}
+
+// CheckIdleConnection serves the server-initiated requests received on an idle connection until the timeout.
+// It returns nil if the connection is still usable.
+func CheckIdleConnection(connection net.Conn, timeout time.Duration) error {
+	connection.SetReadDeadline(time.Now().Add(timeout))
+	defer connection.SetReadDeadline(time.Time{})
+
+	for {
+		reader := &countingReader{reader: connection}
+		message, err := diam.ReadMessage(reader, dict.Default)
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() && reader.n == 0 {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if message.Header.CommandFlags&diam.RequestFlag != 0 {
+			if err := Serve(connection, message); err != nil {
+				return err
+			}
+			if message.Header.CommandCode == diam.DisconnectPeer {
+				return ErrDisconnectPeer
+			}
+		}
+	}
+}
+
+// AnswerSuccess is the handler answering the request with DIAMETER_SUCCESS and its Session-Id.
+func AnswerSuccess(request *diam.Message) *diam.Message {
+	session_id := SessionID(request)
+	log.Printf("Server request, command code %d, %s\n", request.Header.CommandCode, session_id)
+	answer := request.Answer(diam.Success)
+	if session_id != "" {
+		answer.InsertAVP(diam.NewAVP(avp.SessionID, avp.Mbit, 0, session_id))
+	}
+	return answer
+}
+
+// SessionID returns the Session-Id of the message, or "".
+func SessionID(message *diam.Message) datatype.UTF8String {
+	if session, err := message.FindAVP(avp.SessionID, 0); err == nil {
+		if session_id, ok := session.Data.(datatype.UTF8String); ok {
+			return session_id
+		}
+	}
+	return ""
+}
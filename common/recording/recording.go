@@ -0,0 +1,55 @@
+// Package recording is the format of the recordings of the test server (CpoolS -record), replayed by the client
+// (CpoolC -replay): one JSON object per line, a received request each.
+package recording
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// Record is a received request. Message is the raw Diameter message, base64 encoded in JSON.
+type Record struct {
+	Time         time.Time `json:"time"`
+	ConnectionID uint      `json:"connection_id"`
+	Answered     bool      `json:"answered"` // the server answered the request, the replay should wait for the answer
+	Message      []byte    `json:"message"`
+}
+
+// Writer writes the records of a recording, it is not safe for concurrent use.
+type Writer struct {
+	writer  *bufio.Writer
+	encoder *json.Encoder
+}
+
+func NewWriter(w io.Writer) *Writer {
+	writer := bufio.NewWriter(w)
+	return &Writer{writer: writer, encoder: json.NewEncoder(writer)}
+}
+
+// Write writes the record and flushes it, so the recording is complete when the server is killed.
+func (w *Writer) Write(record *Record) error {
+	if err := w.encoder.Encode(record); err != nil {
+		return err
+	}
+	return w.writer.Flush()
+}
+
+// Reader reads the records of a recording.
+type Reader struct {
+	decoder *json.Decoder
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{decoder: json.NewDecoder(r)}
+}
+
+// Read returns the next record, or io.EOF at the end of the recording.
+func (r *Reader) Read() (*Record, error) {
+	record := &Record{}
+	if err := r.decoder.Decode(record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
@@ -0,0 +1,39 @@
+// Package reuseport opens several listening sockets on the same port with SO_REUSEPORT, each served by its own
+// accept loop: the kernel spreads the new connections between them, so a single accept loop is not the bottleneck
+// of the test servers.
+package reuseport
+
+import (
+	"context"
+	"net"
+)
+
+// Listen opens n listeners on the address, with SO_REUSEPORT when n > 1.
+func Listen(bind_address *net.TCPAddr, n int) ([]*net.TCPListener, error) {
+	if n <= 1 {
+		server, err := net.ListenTCP("tcp", bind_address)
+		if err != nil {
+			return nil, err
+		}
+		return []*net.TCPListener{server}, nil
+	}
+
+	config := net.ListenConfig{Control: Control}
+	listeners := make([]*net.TCPListener, 0, n)
+	for i := 0; i < n; i++ {
+		listener, err := config.Listen(context.Background(), "tcp", bind_address.String())
+		if err != nil {
+			Close(listeners)
+			return nil, err
+		}
+		listeners = append(listeners, listener.(*net.TCPListener))
+	}
+	return listeners, nil
+}
+
+// Close closes the listeners.
+func Close(listeners []*net.TCPListener) {
+	for _, listener := range listeners {
+		listener.Close()
+	}
+}
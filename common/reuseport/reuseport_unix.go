@@ -0,0 +1,22 @@
+//go:build !windows
+
+package reuseport
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Control sets SO_REUSEPORT on a listening socket, so several listeners share the port
+// and the kernel balances the new connections between them.
+func Control(network, address string, conn syscall.RawConn) error {
+	var sockopt_err error
+	err := conn.Control(func(fd uintptr) {
+		sockopt_err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockopt_err
+}
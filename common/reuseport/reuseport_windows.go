@@ -0,0 +1,11 @@
+package reuseport
+
+import (
+	"errors"
+	"syscall"
+)
+
+// Control fails, there is no SO_REUSEPORT on Windows: use a single listener.
+func Control(network, address string, conn syscall.RawConn) error {
+	return errors.New("SO_REUSEPORT is not supported on Windows")
+}
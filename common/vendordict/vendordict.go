@@ -0,0 +1,46 @@
+// Package vendordict is the dictionary of the AVPs of the private vendor of the test server, loaded by the server
+// and by the clients, so the answers carrying these AVPs decode on both sides.
+package vendordict
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/fiorix/go-diameter/v4/diam/dict"
+)
+
+const (
+	VendorID                = 99999
+	ReceiveTimestamp uint32 = 1 // Unsigned64, nanoseconds since the Unix epoch
+	SendTimestamp    uint32 = 2 // Unsigned64, nanoseconds since the Unix epoch
+	DeliveryID       uint32 = 3 // Unsigned64, ID of a one-way message to acknowledge
+)
+
+const dictionary = `<?xml version="1.0" encoding="UTF-8"?>
+<diameter>
+	<application id="0">
+		<vendor id="99999" name="CpoolS"/>
+		<avp name="CpoolS-Receive-Timestamp" code="1" must="V" must-not="M" vendor-id="99999">
+			<data type="Unsigned64"/>
+		</avp>
+		<avp name="CpoolS-Send-Timestamp" code="2" must="V" must-not="M" vendor-id="99999">
+			<data type="Unsigned64"/>
+		</avp>
+		<avp name="CpoolS-Delivery-Id" code="3" must="V" must-not="M" vendor-id="99999">
+			<data type="Unsigned64"/>
+		</avp>
+	</application>
+</diameter>`
+
+var (
+	load_once sync.Once
+	load_err  error
+)
+
+// Load loads the dictionary into dict.Default, once.
+func Load() error {
+	load_once.Do(func() {
+		load_err = dict.Default.Load(strings.NewReader(dictionary))
+	})
+	return load_err
+}
@@ -0,0 +1,21 @@
+package main
+
+// SendMultiple writes the messages on one connection of the pool in a single write, where pool.SendMultiple
+// writes them one at a time. The messages are one-way, the connection is released once they are written.
+func SendMultiple(payloads [][]byte) error {
+	size := 0
+	for _, payload := range payloads {
+		size += len(payload)
+	}
+	batch := make([]byte, 0, size)
+	for _, payload := range payloads {
+		batch = append(batch, payload...)
+	}
+
+	resource, err := pool.SendRequest(batch)
+	if err != nil {
+		return err
+	}
+	resource.Release()
+	return nil
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net"
@@ -10,47 +11,59 @@ import (
 	"sync"
 	"time"
 
+	"common/dialer"
+	"common/inbound"
+	"common/vendordict"
+
 	"github.com/fiorix/go-diameter/v4/diam"
 	"github.com/fiorix/go-diameter/v4/diam/avp"
 	"github.com/fiorix/go-diameter/v4/diam/datatype"
-	"github.com/fiorix/go-diameter/v4/diam/dict"
 	MyPool "github.com/tangnguyendeveloper/ConnectionPool/pool"
 )
 
 var pool *MyPool.ConnectionPool
 
-type myKeyType int
-
 var mylog = log.New(os.Stdout, "[ClientTest] ", log.Ldate|log.Ltime)
 
-const (
-	addr_key myKeyType = iota
-
-	// in seconds
-	keep_alive_period_key myKeyType = iota
-)
-
 var gw sync.WaitGroup // for test
 
+var acknowledged = flag.Bool("ack", false, "Wait for the acknowledgment of the one-way messages by the server")
+
 func main() {
 
+	flag.Parse()
+
+	// AVPs of the test server in its answers
+	if err := vendordict.Load(); err != nil {
+		mylog.Println(err)
+		return
+	}
+
+	// Answer the requests of the server read on the connections of the pool
+	inbound.Handle(diam.ReAuth, inbound.AnswerSuccess)
+	inbound.Handle(diam.AbortSession, inbound.AnswerSuccess)
+
+	// Transport of the connections, see the common/dialer package for Unix domain socket, TLS and proxies
+	transport := &dialer.TCPDialer{
+		Address:   "127.0.0.1:8080",
+		Timeout:   5 * time.Second,  // Max time to connect
+		KeepAlive: 30 * time.Second, // Period of the TCP keepalive
+	}
+
 	// Create the pool
 	pool = MyPool.NewConnectionPool(
 		&MyPool.Config{
-			MaxResource:       4,                   // Max connection of the pool
-			MinIdleResource:   2,                   // Min idle connection of the pool
-			Constructor:       CreateNewConnection, // Function to create new connection
-			Destructor:        CloseConnection,     // Function to close connection
-			ReconnectInterval: 5,                   // Time interval to reconnect if the connection of the pool are lost (in seconds)
-			IdleKeepAlive:     120,                 // The time duration to remove the connection of the pool if that connection is not use (in seconds)
+			MaxResource:       4,                                 // Max connection of the pool
+			MinIdleResource:   2,                                 // Min idle connection of the pool
+			Constructor:       CountDialFailures(transport.Dial), // Function to create new connection
+			Destructor:        CountDestroyed(CloseConnection),   // Function to close connection
+			ReconnectInterval: 5,                                 // Time interval to reconnect if the connection of the pool are lost (in seconds)
+			IdleKeepAlive:     120,                               // The time duration to remove the connection of the pool if that connection is not use (in seconds)
 		})
 
-	server_address, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:8080")
-	// configure of connection
 	// connection_config_ctx is the Context Object, this variable can be used to manage life cycle
-	connection_config_ctx := context.WithValue(context.Background(), addr_key, server_address)
-	connection_config_ctx = context.WithValue(connection_config_ctx, keep_alive_period_key, time.Duration(30))
 	// connection_config_ctx can use to close the pool (optional)
+	connection_config_ctx := context.Background()
 	go pool.Start(connection_config_ctx)
 
 	gw.Add(1)
@@ -74,27 +87,31 @@ func main() {
 
 }
 
-func CreateNewConnection(ctx context.Context) (net.Conn, error) {
-	server_address := ctx.Value(addr_key).(*net.TCPAddr)
-	keep_alive_period := ctx.Value(keep_alive_period_key).(time.Duration)
-	connection, err := net.DialTCP("tcp", nil, server_address)
-	if err == nil {
-		connection.SetKeepAlive(true)
-		connection.SetKeepAlivePeriod(keep_alive_period * time.Second)
-	}
-	return connection, err
-}
-
 func CloseConnection(value net.Conn) { value.Close() }
 
-func encapsulation_message(mess datatype.UTF8String) ([]byte, error) {
+func new_message(mess datatype.UTF8String) *diam.Message {
 	msg := diam.NewRequest(diam.Accounting, 0, nil)
 	sessionID := mess
 	msg.NewAVP(avp.SessionID, avp.Mbit, 0, sessionID)
-	return msg.Serialize()
+	return msg
+}
+
+func encapsulation_message(mess datatype.UTF8String) ([]byte, error) {
+	return new_message(mess).Serialize()
 }
 
 func TestSend() {
+	if *acknowledged {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		delivery := SendSingleAcknowledged(ctx, new_message(datatype.UTF8String("test_send_message")))
+		if delivery.Err != nil {
+			mylog.Println(delivery.Err)
+		}
+		mylog.Printf("SendSingle: message %d %s\n", delivery.ID, delivery.Status)
+		return
+	}
+
 	// encapsulation message
 	paylpad, err := encapsulation_message(datatype.UTF8String("test_send_message"))
 	if err != nil {
@@ -110,6 +127,23 @@ func TestSend() {
 }
 
 func TestSendMultiple() {
+	if *acknowledged {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		messages := []*diam.Message{
+			new_message(datatype.UTF8String("test_send_Multiple_message")),
+			new_message(datatype.UTF8String("test_send_Multiple_message")),
+		}
+		deliveries, err := SendMultipleAcknowledged(ctx, messages)
+		if err != nil {
+			mylog.Println(err)
+		}
+		for _, delivery := range deliveries {
+			mylog.Printf("SendMultiple: message %d %s\n", delivery.ID, delivery.Status)
+		}
+		return
+	}
+
 	// encapsulation message
 	paylpad, err := encapsulation_message(datatype.UTF8String("test_send_Multiple_message"))
 	if err != nil {
@@ -119,7 +153,7 @@ func TestSendMultiple() {
 
 	paylpads := [][]byte{paylpad, paylpad}
 
-	err = pool.SendMultiple(paylpads)
+	err = SendMultiple(paylpads)
 	if err != nil {
 		mylog.Println(err)
 	}
@@ -128,45 +162,36 @@ func TestSendMultiple() {
 
 func TestSendRequest() {
 
-	request, err := encapsulation_message(datatype.UTF8String("test_request_message"))
-	if err != nil {
-		mylog.Println(err)
-	}
+	request := diam.NewRequest(diam.Accounting, 0, nil)
+	request.NewAVP(avp.SessionID, avp.Mbit, 0, datatype.UTF8String("test_request_message"))
 
-	resource, err := pool.SendRequest(request)
-	if err != nil {
-		mylog.Println(err)
-		return
-	}
-	mylog.Println("SendRequest")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 
-	response, err := diam.ReadMessage(resource.Value().(*net.TCPConn), dict.Default)
+	response, err := Exchange(ctx, request)
 	if err != nil {
 		mylog.Println(err)
-		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-			resource.Release()
-			return
-		}
-		resource.Destroy()
 		return
 	}
+	mylog.Println("SendRequest")
 
 	mylog.Printf("\n%v\n", response.String())
-	time.Sleep(5 * time.Second) // for test
-	resource.Release()
 
 }
 
+// PoolInfo prints the stats of the pool every second, it subscribes again when its subscription is dropped.
 func PoolInfo() {
-	js := make(map[string]uint64)
 	defer gw.Done()
 	for {
-		js["AcquiredResources"] = pool.NumActiveResource()
-		js["IdleResources"] = pool.NumIdleResource()
-		js["TotalResources"] = pool.NumResource()
-		js["MaxResources"] = pool.Config().MaxResource
-		jsonData, _ := json.Marshal(js)
-		fmt.Println(string(jsonData))
-		time.Sleep(time.Second)
+		snapshots, _, err := Subscribe(pool, time.Second)
+		if err != nil {
+			mylog.Println(err)
+			return
+		}
+		for stats := range snapshots {
+			jsonData, _ := json.Marshal(stats)
+			fmt.Println(string(jsonData))
+		}
+		mylog.Println("Pool stats subscription dropped, subscribing again")
 	}
 }
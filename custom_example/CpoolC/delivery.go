@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	"common/exchange"
+	"common/inbound"
+	"common/vendordict"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+	"github.com/fiorix/go-diameter/v4/diam/dict"
+)
+
+// Delivery confirmation of the one-way messages: in the acknowledged mode every message carries a Delivery-ID,
+// the test server acknowledges it with an answer carrying the same Delivery-ID, and the call returns the status of each message.
+
+type DeliveryStatus int
+
+const (
+	DeliveryFailed       DeliveryStatus = iota // not written, or refused by the server
+	DeliveryWritten                            // written, not acknowledged
+	DeliveryAcknowledged                       // acknowledged by the server
+)
+
+func (status DeliveryStatus) String() string {
+	switch status {
+	case DeliveryWritten:
+		return "written"
+	case DeliveryAcknowledged:
+		return "acknowledged"
+	}
+	return "failed"
+}
+
+// Delivery is the delivery status of a message.
+type Delivery struct {
+	ID     uint64
+	Status DeliveryStatus
+	Err    error
+}
+
+// DeliveryError reports a batch with messages not acknowledged.
+type DeliveryError struct {
+	Acknowledged int
+	Written      int
+	Failed       int
+}
+
+func (e *DeliveryError) Error() string {
+	return fmt.Sprintf("partial delivery: %d acknowledged, %d written, %d failed", e.Acknowledged, e.Written, e.Failed)
+}
+
+var next_delivery_id uint64
+
+// SendSingleAcknowledged sends a one-way message and waits for its acknowledgment.
+func SendSingleAcknowledged(ctx context.Context, message *diam.Message) Delivery {
+	deliveries, _ := SendMultipleAcknowledged(ctx, []*diam.Message{message})
+	return deliveries[0]
+}
+
+// SendMultipleAcknowledged sends the one-way messages in one write on a connection of the pool, and waits for
+// the acknowledgment of each until the context is done. It returns the delivery of each message, and a *DeliveryError
+// if any is not acknowledged.
+func SendMultipleAcknowledged(ctx context.Context, messages []*diam.Message) ([]Delivery, error) {
+	deliveries := make([]Delivery, len(messages))
+	pending := make(map[uint64]int) // Delivery-ID -> index of the message
+	var payload []byte
+
+	for i, message := range messages {
+		id := atomic.AddUint64(&next_delivery_id, 1)
+		deliveries[i].ID = id
+		message.NewAVP(vendordict.DeliveryID, avp.Vbit, vendordict.VendorID, datatype.Unsigned64(id))
+		b, err := message.Serialize()
+		if err != nil {
+			deliveries[i].Err = err
+			continue
+		}
+		payload = append(payload, b...)
+		pending[id] = i
+	}
+
+	if len(pending) > 0 {
+		resource, err := pool.SendRequest(payload)
+		if err != nil {
+			for _, i := range pending {
+				deliveries[i].Err = err
+			}
+			return deliveries, deliveryError(deliveries)
+		}
+		for _, i := range pending {
+			deliveries[i].Status = DeliveryWritten
+		}
+
+		connection, ok := resource.Value().(net.Conn)
+		if !ok {
+			err = fmt.Errorf("pool resource %T is not a connection", resource.Value())
+		} else {
+			err = readAcknowledgments(ctx, connection, pending, deliveries)
+		}
+		if err != nil {
+			// the acknowledgments still pending would stay in the stream
+			resource.Destroy()
+			for _, i := range pending {
+				deliveries[i].Err = err
+			}
+		} else {
+			resource.Release()
+		}
+	}
+	return deliveries, deliveryError(deliveries)
+}
+
+// readAcknowledgments reads the acknowledgments of the pending messages, until all are received.
+// The server-initiated requests read meanwhile are served by their handler.
+func readAcknowledgments(ctx context.Context, connection net.Conn, pending map[uint64]int, deliveries []Delivery) error {
+	stop := exchange.WatchContext(ctx, connection)
+	defer stop()
+
+	for len(pending) > 0 {
+		answer, err := diam.ReadMessage(connection, dict.Default)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if answer.Header.CommandFlags&diam.RequestFlag != 0 {
+			if err := inbound.Serve(connection, answer); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var id uint64
+		if a, err := answer.FindAVP(vendordict.DeliveryID, vendordict.VendorID); err == nil {
+			if value, ok := a.Data.(datatype.Unsigned64); ok {
+				id = uint64(value)
+			}
+		}
+		i, ok := pending[id]
+		if !ok {
+			return fmt.Errorf("unexpected answer, Hop-by-Hop ID %#x, Delivery-ID %d", answer.Header.HopByHopID, id)
+		}
+		delete(pending, id)
+
+		if result := resultCode(answer); result == diam.Success {
+			deliveries[i].Status = DeliveryAcknowledged
+		} else {
+			deliveries[i].Status = DeliveryFailed
+			deliveries[i].Err = fmt.Errorf("refused by the server, Result-Code %d", result)
+		}
+	}
+	return nil
+}
+
+func deliveryError(deliveries []Delivery) error {
+	e := &DeliveryError{}
+	for _, delivery := range deliveries {
+		switch delivery.Status {
+		case DeliveryAcknowledged:
+			e.Acknowledged++
+		case DeliveryWritten:
+			e.Written++
+		default:
+			e.Failed++
+		}
+	}
+	if e.Acknowledged == len(deliveries) {
+		return nil
+	}
+	return e
+}
+
+func resultCode(answer *diam.Message) uint32 {
+	if result, err := answer.FindAVP(avp.ResultCode, 0); err == nil {
+		if value, ok := result.Data.(datatype.Unsigned32); ok {
+			return uint32(value)
+		}
+	}
+	return 0
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"common/exchange"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+)
+
+// Exchange sends the request on a connection of the pool and returns its answer (see exchange.ReadAnswer).
+// The connection is released to the pool once the answer is read, and destroyed on any error or when the context
+// is done, so an answer arriving late never stays in the stream of a pooled connection.
+func Exchange(ctx context.Context, request *diam.Message) (*diam.Message, error) {
+	payload, err := request.Serialize()
+	if err != nil {
+		return nil, err
+	}
+	resource, err := pool.SendRequest(payload)
+	if err != nil {
+		return nil, err
+	}
+	connection, ok := resource.Value().(net.Conn)
+	if !ok {
+		resource.Destroy()
+		return nil, fmt.Errorf("pool resource %T is not a connection", resource.Value())
+	}
+
+	answer, err := exchange.ReadAnswer(ctx, connection, request)
+	if err != nil {
+		resource.Destroy()
+		return nil, err
+	}
+	resource.Release()
+	return answer, nil
+}
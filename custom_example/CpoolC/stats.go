@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	MyPool "github.com/tangnguyendeveloper/ConnectionPool/pool"
+)
+
+// PoolStats is a snapshot of the state of the pool, every subscription takes its own snapshots.
+type PoolStats struct {
+	Time         time.Time
+	Acquired     uint64
+	Idle         uint64
+	Total        uint64
+	Max          uint64
+	DialFailures uint64 // since the start of the client
+	Destroyed    uint64 // since the start of the client, MyPool does not tell the reason
+}
+
+// counters of the stats, updated by the Constructor and the Destructor of the pool
+var (
+	dial_failures uint64
+	destroyed     uint64
+)
+
+// CountDialFailures wraps the Constructor of the pool to count its failures.
+func CountDialFailures(dial func(ctx context.Context) (net.Conn, error)) func(ctx context.Context) (net.Conn, error) {
+	return func(ctx context.Context) (net.Conn, error) {
+		connection, err := dial(ctx)
+		if err != nil {
+			atomic.AddUint64(&dial_failures, 1)
+		}
+		return connection, err
+	}
+}
+
+// CountDestroyed wraps the Destructor of the pool to count the closed connections.
+func CountDestroyed(destroy func(net.Conn)) func(net.Conn) {
+	return func(connection net.Conn) {
+		atomic.AddUint64(&destroyed, 1)
+		destroy(connection)
+	}
+}
+
+func Stats(pool *MyPool.ConnectionPool) PoolStats {
+	return PoolStats{
+		Time:         time.Now(),
+		Acquired:     pool.NumActiveResource(),
+		Idle:         pool.NumIdleResource(),
+		Total:        pool.NumResource(),
+		Max:          pool.Config().MaxResource,
+		DialFailures: atomic.LoadUint64(&dial_failures),
+		Destroyed:    atomic.LoadUint64(&destroyed),
+	}
+}
+
+// subscription_buffer is the number of snapshots a subscriber may lag behind before it is dropped
+const subscription_buffer = 4
+
+// Subscribe returns a channel receiving a snapshot of the stats of the pool every interval, until unsubscribe is called.
+// A subscriber not reading its snapshots is dropped, its channel is closed, so it never blocks the pool or the other subscribers.
+func Subscribe(pool *MyPool.ConnectionPool, interval time.Duration) (snapshots <-chan PoolStats, unsubscribe func(), err error) {
+	if interval <= 0 {
+		return nil, nil, fmt.Errorf("stats interval %s is not positive", interval)
+	}
+	channel := make(chan PoolStats, subscription_buffer)
+	stop := make(chan struct{})
+	var stop_once sync.Once
+
+	go func() {
+		defer close(channel)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+			select {
+			case channel <- Stats(pool):
+			default:
+				// slow subscriber
+				return
+			}
+		}
+	}()
+	return channel, func() { stop_once.Do(func() { close(stop) }) }, nil
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"time"
+
+	"common/admit"
+)
+
+// Admission control of the test server, used to benchmark how the client pool reacts to overload (see common/admit).
+var admission_config = admit.RegisterFlags()
+
+var admission *admit.Control
+
+func initAdmission() {
+	admission = admit.New(*admission_config)
+}
+
+// AdmissionInfo prints the state of the admission control every second.
+func AdmissionInfo() {
+	for {
+		mylog.Println(admission)
+		time.Sleep(time.Second)
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+)
+
+// Accounting CDR sink: every Accounting-Request answered successfully is written as a CDR, and the
+// Accounting-Record-Number of each session is checked for gaps and duplicates, to verify that the pool loses
+// no accounting data.
+var (
+	cdr_file            = flag.String("cdr", "", "Write the Accounting-Requests as CDR to this file")
+	cdr_format          = flag.String("cdr-format", "jsonl", "Format of the CDR file: jsonl or csv")
+	cdr_max_size        = flag.Int64("cdr-max-size", 0, "Rotate the CDR file when it reaches this size in bytes (0: no limit)")
+	cdr_rotate_interval = flag.Duration("cdr-rotate-interval", 0, "Rotate the CDR file at this interval (0: never)")
+	cdr_session_timeout = flag.Duration("cdr-session-timeout", time.Hour, "Forget the record numbers of a session without record for this time (0: never)")
+)
+
+// Accounting-Record-Type of the records without session, and of the last record of a session
+const (
+	event_record = 1
+	stop_record  = 4
+)
+
+type CDR struct {
+	Received       time.Time  `json:"received"`
+	ConnectionID   uint       `json:"connection_id"`
+	Peer           string     `json:"peer"`
+	OriginHost     string     `json:"origin_host,omitempty"`
+	SessionID      string     `json:"session_id"`
+	RecordType     uint32     `json:"record_type"`
+	RecordNumber   *uint32    `json:"record_number,omitempty"`
+	EventTimestamp *time.Time `json:"event_timestamp,omitempty"`
+	Duplicate      bool       `json:"duplicate"`
+	Missing        uint32     `json:"missing"` // record numbers skipped before this one
+}
+
+var cdr_columns = []string{"received", "connection_id", "peer", "origin_host", "session_id", "record_type",
+	"record_number", "event_timestamp", "duplicate", "missing"}
+
+func (cdr *CDR) columns() []string {
+	record_number, event_timestamp := "", ""
+	if cdr.RecordNumber != nil {
+		record_number = strconv.FormatUint(uint64(*cdr.RecordNumber), 10)
+	}
+	if cdr.EventTimestamp != nil {
+		event_timestamp = cdr.EventTimestamp.Format(time.RFC3339)
+	}
+	return []string{
+		cdr.Received.Format(time.RFC3339Nano),
+		strconv.FormatUint(uint64(cdr.ConnectionID), 10),
+		cdr.Peer,
+		cdr.OriginHost,
+		cdr.SessionID,
+		strconv.FormatUint(uint64(cdr.RecordType), 10),
+		record_number,
+		event_timestamp,
+		strconv.FormatBool(cdr.Duplicate),
+		strconv.FormatUint(uint64(cdr.Missing), 10),
+	}
+}
+
+// accountingSession tracks the record numbers received in a session.
+type accountingSession struct {
+	seen    map[uint32]bool
+	highest uint32
+	last    time.Time // received time of the last record
+}
+
+type cdrSink struct {
+	mux sync.Mutex
+
+	path     string
+	format   string
+	file     *os.File
+	writer   *bufio.Writer
+	size     int64
+	opened   time.Time
+	sessions map[string]*accountingSession
+	expired  time.Time // last check of the session timeouts
+
+	// set by a hot restart: the new process owns the file, this one appends to it without rotating it
+	handed_off bool
+
+	// counters, for the stats
+	records    uint64
+	duplicates uint64
+	missing    uint64
+}
+
+// a nil *cdrSink writes nothing
+var cdr_sink *cdrSink
+
+func initCDRSink() error {
+	if *cdr_file == "" {
+		return nil
+	}
+	if *cdr_format != "jsonl" && *cdr_format != "csv" {
+		return fmt.Errorf("unknown CDR format %q", *cdr_format)
+	}
+
+	sink := &cdrSink{path: *cdr_file, format: *cdr_format, sessions: make(map[string]*accountingSession)}
+	if err := sink.open(); err != nil {
+		return err
+	}
+	cdr_sink = sink
+	if *cdr_rotate_interval > 0 {
+		go cdr_sink.RotateForever(*cdr_rotate_interval)
+	}
+	mylog.Printf("Writing CDR to %s (%s)\n", *cdr_file, *cdr_format)
+	return nil
+}
+
+func (sink *cdrSink) open() error {
+	file, err := os.OpenFile(sink.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	sink.file = file
+	sink.writer = bufio.NewWriter(file)
+	sink.size = info.Size()
+	sink.opened = time.Now()
+
+	if sink.format == "csv" && sink.size == 0 {
+		return sink.writeCSV(cdr_columns)
+	}
+	return nil
+}
+
+// HandOff stops the rotations of the file, the CDR are still appended to it until the connections are drained.
+func (sink *cdrSink) HandOff() {
+	if sink == nil {
+		return
+	}
+	sink.mux.Lock()
+	defer sink.mux.Unlock()
+	sink.handed_off = true
+}
+
+// rotate renames the current file with its opening time and opens a new one, the caller holds the lock.
+func (sink *cdrSink) rotate() error {
+	if sink.handed_off {
+		return nil
+	}
+	if err := sink.writer.Flush(); err != nil {
+		return err
+	}
+	if err := sink.file.Close(); err != nil {
+		return err
+	}
+	rotated := fmt.Sprintf("%s.%s", sink.path, sink.opened.Format("20060102T150405.000"))
+	if err := os.Rename(sink.path, rotated); err != nil {
+		return err
+	}
+	mylog.Printf("Rotated CDR file to %s\n", rotated)
+	return sink.open()
+}
+
+func (sink *cdrSink) RotateForever(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		sink.mux.Lock()
+		if sink.size > 0 {
+			if err := sink.rotate(); err != nil {
+				mylog.Printf("CDR rotate: %v\n", err)
+			}
+		}
+		sink.mux.Unlock()
+	}
+}
+
+func (sink *cdrSink) writeCSV(columns []string) error {
+	w := csv.NewWriter(&countingWriter{sink})
+	if err := w.Write(columns); err != nil {
+		return err
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// countingWriter keeps the size of the CDR file up to date.
+type countingWriter struct {
+	sink *cdrSink
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.sink.writer.Write(b)
+	w.sink.size += int64(n)
+	return n, err
+}
+
+// Write writes the CDR of an Accounting-Request once its answer is written, other requests are ignored,
+// and so are the requests not answered or answered with a failure: the client sends them again.
+func (sink *cdrSink) Write(connection *serverConnection, request, answer *diam.Message, received time.Time) {
+	if sink == nil || request.Header.CommandCode != diam.Accounting || !successful(answer) {
+		return
+	}
+
+	cdr := &CDR{
+		Received:     received,
+		ConnectionID: connection.id,
+		Peer:         connection.RemoteAddr().String(),
+		SessionID:    sessionID(request),
+	}
+	if origin, err := request.FindAVP(avp.OriginHost, 0); err == nil {
+		cdr.OriginHost = AVPValueString(origin.Data)
+	}
+	if record_type, err := request.FindAVP(avp.AccountingRecordType, 0); err == nil {
+		if value, ok := record_type.Data.(datatype.Enumerated); ok {
+			cdr.RecordType = uint32(value)
+		}
+	}
+	if record_number, err := request.FindAVP(avp.AccountingRecordNumber, 0); err == nil {
+		if value, ok := record_number.Data.(datatype.Unsigned32); ok {
+			number := uint32(value)
+			cdr.RecordNumber = &number
+		}
+	}
+	if event_timestamp, err := request.FindAVP(avp.EventTimestamp, 0); err == nil {
+		if value, ok := event_timestamp.Data.(datatype.Time); ok {
+			t := time.Time(value)
+			cdr.EventTimestamp = &t
+		}
+	}
+
+	sink.mux.Lock()
+	defer sink.mux.Unlock()
+
+	sink.check(cdr)
+
+	var err error
+	if sink.format == "csv" {
+		err = sink.writeCSV(cdr.columns())
+	} else {
+		var line []byte
+		if line, err = json.Marshal(cdr); err == nil {
+			_, err = (&countingWriter{sink}).Write(append(line, '\n'))
+		}
+	}
+	if err == nil {
+		// flush every CDR, so the file is complete when the server is killed
+		err = sink.writer.Flush()
+	}
+	if err != nil {
+		mylog.Printf("CDR: %v\n", err)
+		return
+	}
+	sink.records++
+
+	if *cdr_max_size > 0 && sink.size >= *cdr_max_size {
+		if err := sink.rotate(); err != nil {
+			mylog.Printf("CDR rotate: %v\n", err)
+		}
+	}
+}
+
+// successful reports whether the answer is not a failure, the Result-Code is not 3xxx, 4xxx or 5xxx.
+func successful(answer *diam.Message) bool {
+	if answer == nil || answer.Header.CommandFlags&diam.ErrorFlag != 0 {
+		return false
+	}
+	result_code, err := answer.FindAVP(avp.ResultCode, 0)
+	if err != nil {
+		return false
+	}
+	code, ok := result_code.Data.(datatype.Unsigned32)
+	return ok && code < 3000
+}
+
+// expire forgets the sessions without record for cdr-session-timeout, they never received their STOP record.
+// The caller holds the lock.
+func (sink *cdrSink) expire(now time.Time) {
+	if *cdr_session_timeout <= 0 || now.Sub(sink.expired) < *cdr_session_timeout/10 {
+		return
+	}
+	sink.expired = now
+	for session_id, session := range sink.sessions {
+		if now.Sub(session.last) > *cdr_session_timeout {
+			mylog.Printf("CDR: session %s expired without STOP record, %d records\n", session_id, len(session.seen))
+			delete(sink.sessions, session_id)
+		}
+	}
+}
+
+// check detects the duplicate and missing record numbers of the session, the caller holds the lock.
+// The EVENT records are single records, they are not tracked.
+func (sink *cdrSink) check(cdr *CDR) {
+	sink.expire(cdr.Received)
+	if cdr.RecordNumber == nil || cdr.RecordType == event_record {
+		return
+	}
+	number := *cdr.RecordNumber
+
+	session, ok := sink.sessions[cdr.SessionID]
+	if !ok {
+		session = &accountingSession{seen: make(map[uint32]bool)}
+		sink.sessions[cdr.SessionID] = session
+		// the first record of a session has number 0
+		if number > 0 {
+			cdr.Missing = number
+		}
+	} else if session.seen[number] {
+		cdr.Duplicate = true
+		sink.duplicates++
+		mylog.Printf("CDR: duplicate Accounting-Record-Number %d in session %s\n", number, cdr.SessionID)
+	} else if number > session.highest+1 {
+		cdr.Missing = number - session.highest - 1
+	}
+
+	session.seen[number] = true
+	session.last = cdr.Received
+	if number > session.highest {
+		session.highest = number
+	}
+	if cdr.Missing > 0 {
+		mylog.Printf("CDR: %d Accounting-Record-Number missing before %d in session %s\n", cdr.Missing, number, cdr.SessionID)
+	}
+
+	if cdr.RecordType == stop_record {
+		var missing uint32
+		for n := uint32(0); n < session.highest; n++ {
+			if !session.seen[n] {
+				missing++
+			}
+		}
+		sink.missing += uint64(missing)
+		mylog.Printf("CDR: session %s stopped, %d records, %d missing (total: %d CDR, %d duplicates, %d missing)\n",
+			cdr.SessionID, len(session.seen), missing, sink.records+1, sink.duplicates, sink.missing)
+		delete(sink.sessions, cdr.SessionID)
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+)
+
+// Online charging simulator: the Credit-Control-Requests are answered from the balance of the subscriber,
+// loaded from a JSON file {"subscriber": units, ...} and saved back on shutdown. The save merges the changes
+// of the balances since they were loaded into the file, so the old and the new process of a hot restart
+// both keep their changes.
+var (
+	ocs_balances = flag.String("ocs-balances", "", "JSON file of the subscriber balances, enables the online charging simulator")
+	ocs_grant    = flag.Uint64("ocs-grant", 1000, "Units granted by CCR-I/U without Requested-Service-Unit")
+	ocs_unit     = flag.String("ocs-unit", "octets", "Service unit of the balances: octets (CC-Total-Octets) or time (CC-Time)")
+)
+
+// CC-Request-Type values
+const (
+	initial_request     = 1
+	update_request      = 2
+	termination_request = 3
+	event_request       = 4
+)
+
+// Result-Code of RFC 4006
+const (
+	credit_limit_reached = 4012 // DIAMETER_CREDIT_LIMIT_REACHED
+	user_unknown         = 5030 // DIAMETER_USER_UNKNOWN
+)
+
+// creditSession is the reservation of an ongoing charging session.
+type creditSession struct {
+	subscriber string
+	reserved   uint64
+}
+
+type chargingServer struct {
+	mux      sync.Mutex
+	balances map[string]uint64 // units available, without the reservations
+	loaded   map[string]uint64 // balances in the file when loaded or saved last
+	sessions map[string]*creditSession
+}
+
+// a nil *chargingServer leaves the Credit-Control-Requests to the rules
+var ocs *chargingServer
+
+func initCharging() error {
+	if *ocs_balances == "" {
+		return nil
+	}
+	if *ocs_unit != "octets" && *ocs_unit != "time" {
+		return fmt.Errorf("unknown service unit %q", *ocs_unit)
+	}
+
+	balances, err := readBalances(*ocs_balances)
+	if err != nil {
+		return err
+	}
+
+	ocs = &chargingServer{balances: balances, loaded: copyBalances(balances), sessions: make(map[string]*creditSession)}
+	OnShutdown(func() {
+		if err := ocs.Save(*ocs_balances); err != nil {
+			mylog.Printf("Save balances: %v\n", err)
+		}
+	})
+	mylog.Printf("Loaded %d subscriber balances from %s\n", len(balances), *ocs_balances)
+	return nil
+}
+
+// Handles reports whether the request is a Credit-Control-Request answered by the charging server.
+func (ocs *chargingServer) Handles(request *diam.Message) bool {
+	return ocs != nil && request.Header.CommandCode == diam.CreditControl
+}
+
+// Save writes the balances to the file, the reserved units are given back to the subscribers first.
+// The changes since the balances were loaded are applied to the balances of the file, under the lock of the file,
+// so the saves of another process of the server are kept.
+func (ocs *chargingServer) Save(file string) error {
+	ocs.mux.Lock()
+	defer ocs.mux.Unlock()
+
+	for session_id, session := range ocs.sessions {
+		ocs.balances[session.subscriber] += session.reserved
+		delete(ocs.sessions, session_id)
+	}
+
+	unlock, err := lockFile(file)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	saved, err := readBalances(file)
+	if err != nil {
+		return err
+	}
+	for subscriber, balance := range ocs.balances {
+		merged := int64(saved[subscriber]) + int64(balance) - int64(ocs.loaded[subscriber])
+		if merged < 0 {
+			merged = 0
+		}
+		saved[subscriber] = uint64(merged)
+	}
+
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		return err
+	}
+	ocs.balances, ocs.loaded = saved, copyBalances(saved)
+	mylog.Printf("Saved %d subscriber balances to %s\n", len(saved), file)
+	return nil
+}
+
+func readBalances(file string) (map[string]uint64, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	balances := make(map[string]uint64)
+	if err := json.Unmarshal(data, &balances); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return balances, nil
+}
+
+func copyBalances(balances map[string]uint64) map[string]uint64 {
+	copied := make(map[string]uint64, len(balances))
+	for subscriber, balance := range balances {
+		copied[subscriber] = balance
+	}
+	return copied
+}
+
+// lock_timeout is the max time to wait for the lock of the balances file held by another process
+const lock_timeout = 10 * time.Second
+
+// lockFile creates the lock file of the file, held until unlock is called.
+func lockFile(file string) (unlock func(), err error) {
+	lock := file + ".lock"
+	deadline := time.Now().Add(lock_timeout)
+	for {
+		f, err := os.OpenFile(lock, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(lock) }, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%s: locked for %s", lock, lock_timeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Answer builds the Credit-Control-Answer and updates the balance of the subscriber.
+func (ocs *chargingServer) Answer(request *diam.Message) *diam.Message {
+	session_id := sessionID(request)
+	request_type := uint32(unsignedAVP(request, avp.CCRequestType))
+	requested, has_requested := serviceUnits(request, avp.RequestedServiceUnit)
+	used, _ := serviceUnits(request, avp.UsedServiceUnit)
+	if !has_requested {
+		requested = *ocs_grant
+	}
+
+	ocs.mux.Lock()
+	defer ocs.mux.Unlock()
+
+	result_code := uint32(diam.Success)
+	var granted uint64
+
+	switch request_type {
+	case initial_request:
+		// a new CCR-I of an open session starts it again: its reservation is refunded first
+		if session, ok := ocs.sessions[session_id]; ok {
+			ocs.balances[session.subscriber] += session.reserved
+			delete(ocs.sessions, session_id)
+			mylog.Printf("CCR-I of open session %s, refunded %d units to %s\n", session_id, session.reserved, session.subscriber)
+		}
+		subscriber := subscriberID(request)
+		balance, ok := ocs.balances[subscriber]
+		if !ok {
+			result_code = user_unknown
+			break
+		}
+		granted = min64(requested, balance)
+		if granted == 0 {
+			result_code = credit_limit_reached
+			break
+		}
+		ocs.balances[subscriber] -= granted
+		ocs.sessions[session_id] = &creditSession{subscriber: subscriber, reserved: granted}
+
+	case update_request, termination_request:
+		session, ok := ocs.sessions[session_id]
+		if !ok {
+			result_code = diam.UnknownSessionID
+			break
+		}
+		// deduct the used units from the reservation, the units used above the reservation from the balance
+		if used > session.reserved {
+			ocs.balances[session.subscriber] -= min64(used-session.reserved, ocs.balances[session.subscriber])
+		} else {
+			ocs.balances[session.subscriber] += session.reserved - used
+		}
+		session.reserved = 0
+
+		if request_type == termination_request {
+			delete(ocs.sessions, session_id)
+			break
+		}
+		granted = min64(requested, ocs.balances[session.subscriber])
+		if granted == 0 {
+			result_code = credit_limit_reached
+			break
+		}
+		ocs.balances[session.subscriber] -= granted
+		session.reserved = granted
+
+	case event_request:
+		subscriber := subscriberID(request)
+		balance, ok := ocs.balances[subscriber]
+		if !ok {
+			result_code = user_unknown
+			break
+		}
+		if balance < requested {
+			result_code = credit_limit_reached
+			break
+		}
+		ocs.balances[subscriber] -= requested
+		granted = requested
+
+	default:
+		result_code = diam.InvalidAVPValue
+	}
+
+	answer := request.Answer(result_code)
+	answer.InsertAVP(diam.NewAVP(avp.SessionID, avp.Mbit, 0, datatype.UTF8String(session_id)))
+	answer.NewAVP(avp.OriginHost, avp.Mbit, 0, origin_host)
+	answer.NewAVP(avp.OriginRealm, avp.Mbit, 0, origin_realm)
+	answer.NewAVP(avp.CCRequestType, avp.Mbit, 0, datatype.Enumerated(request_type))
+	answer.NewAVP(avp.CCRequestNumber, avp.Mbit, 0, datatype.Unsigned32(unsignedAVP(request, avp.CCRequestNumber)))
+	if granted > 0 {
+		answer.NewAVP(avp.GrantedServiceUnit, avp.Mbit, 0, &diam.GroupedAVP{
+			AVP: []*diam.AVP{serviceUnitAVP(granted)},
+		})
+	}
+	return answer
+}
+
+// subscriberID is the first Subscription-Id-Data of the request, or its User-Name.
+func subscriberID(request *diam.Message) string {
+	if data, err := request.FindAVPsWithPath([]interface{}{avp.SubscriptionID, avp.SubscriptionIDData}, 0); err == nil && len(data) > 0 {
+		return AVPValueString(data[0].Data)
+	}
+	if user_name, err := request.FindAVP(avp.UserName, 0); err == nil {
+		return AVPValueString(user_name.Data)
+	}
+	return ""
+}
+
+// serviceUnits returns the units of a Requested-Service-Unit or Used-Service-Unit of the request.
+func serviceUnits(request *diam.Message, service_unit uint32) (uint64, bool) {
+	code := uint32(avp.CCTotalOctets)
+	if *ocs_unit == "time" {
+		code = avp.CCTime
+	}
+	units, err := request.FindAVPsWithPath([]interface{}{service_unit, code}, 0)
+	if err != nil || len(units) == 0 {
+		return 0, false
+	}
+	switch value := units[0].Data.(type) {
+	case datatype.Unsigned64:
+		return uint64(value), true
+	case datatype.Unsigned32:
+		return uint64(value), true
+	}
+	return 0, false
+}
+
+func serviceUnitAVP(units uint64) *diam.AVP {
+	if *ocs_unit == "time" {
+		return diam.NewAVP(avp.CCTime, avp.Mbit, 0, datatype.Unsigned32(units))
+	}
+	return diam.NewAVP(avp.CCTotalOctets, avp.Mbit, 0, datatype.Unsigned64(units))
+}
+
+// unsignedAVP returns the value of an Unsigned32 or Enumerated AVP, or 0.
+func unsignedAVP(message *diam.Message, code uint32) uint64 {
+	if a, err := message.FindAVP(code, 0); err == nil {
+		switch value := a.Data.(type) {
+		case datatype.Unsigned32:
+			return uint64(value)
+		case datatype.Enumerated:
+			return uint64(value)
+		}
+	}
+	return 0
+}
+
+func min64(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -1,48 +1,163 @@
 package main
 
 import (
+	"bytes"
+	"errors"
+	"flag"
+	"io"
 	"log"
 	"net"
 	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"common/admit"
+	"common/vendordict"
+
 	"github.com/fiorix/go-diameter/v4/diam"
 	"github.com/fiorix/go-diameter/v4/diam/avp"
-	"github.com/fiorix/go-diameter/v4/diam/datatype"
-	"github.com/fiorix/go-diameter/v4/diam/dict"
 )
 
+var address = flag.String("address", "127.0.0.1:8080", "Address of the server")
+
 var mylog = log.New(os.Stdout, "[ServerTest] ", log.Ldate|log.Ltime)
 
 func main() {
-	bind_address, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:8080")
-	server, err := net.ListenTCP("tcp", bind_address)
+	flag.Parse()
+	if err := vendordict.Load(); err != nil {
+		mylog.Println(err)
+		return
+	}
+	initAdmission()
+	initDuplicateCache()
+	if err := initOverloadControl(); err != nil {
+		mylog.Println(err)
+		return
+	}
+	if err := LoadRules(); err != nil {
+		mylog.Println(err)
+		return
+	}
+	if err := LoadAllowlist(); err != nil {
+		mylog.Println(err)
+		return
+	}
+	go ReloadOnSignal()
+	if err := initRecorder(); err != nil {
+		mylog.Println(err)
+		return
+	}
+	if err := initCDRSink(); err != nil {
+		mylog.Println(err)
+		return
+	}
+	if err := initCharging(); err != nil {
+		mylog.Println(err)
+		return
+	}
+	if err := initRedirect(); err != nil {
+		mylog.Println(err)
+		return
+	}
+	go ShutdownOnSignal()
+
+	bind_address, err := net.ResolveTCPAddr("tcp", *address)
 	if err != nil {
 		mylog.Println(err)
 		return
 	}
+	listeners, err := Listen(bind_address, *num_listeners)
+	if err != nil {
+		mylog.Println(err)
+		return
+	}
+
+	stats := make([]*listenerStats, len(listeners))
+	for i, server := range listeners {
+		stats[i] = &listenerStats{id: i + 1}
+		mylog.Printf("Serve at %s [ listener %d ]\n", server.Addr(), i+1)
+	}
 
-	mylog.Printf("Serve at %s\n", server.Addr())
+	if admission.Enabled() {
+		go AdmissionInfo()
+	}
+	if len(listeners) > 1 {
+		go ListenerInfo(stats)
+	}
+	go PushForever()
+	go RestartOnSignal(listeners)
+
+	var wg sync.WaitGroup
+	for i, server := range listeners {
+		wg.Add(1)
+		go func(server *net.TCPListener, stats *listenerStats) {
+			defer wg.Done()
+			acceptConnections(server, stats)
+		}(server, stats[i])
+	}
+	NotifyReady()
+	wg.Wait()
+
+	DrainConnections(*drain_timeout)
+	Shutdown()
+}
 
-	connection_count := 1
+var connection_count uint64 = 0
 
+// acceptConnections is the accept loop of a listener, it returns when the listener is closed by a hot restart.
+func acceptConnections(server *net.TCPListener, stats *listenerStats) {
 	for {
 		client, err := server.AcceptTCP()
-		if err != nil {
+		if errors.Is(err, net.ErrClosed) {
+			// hot restart, the new process accepts the connections now
+			return
+		} else if err != nil {
 			mylog.Println(err)
 			continue
 		}
-		go handleConnection(client, uint(connection_count))
-		connection_count++
+		if !CurrentAllowlist().AllowsAddress(client.RemoteAddr()) {
+			mylog.Printf("Rejected connection %s, address not allowed\n", client.RemoteAddr())
+			client.Close()
+			continue
+		}
+		if !admission.AcceptConnection() {
+			mylog.Printf("Rejected connection %s, max connections (%d) reached\n", client.RemoteAddr(), admission.MaxConnections())
+			client.Close()
+			continue
+		}
+		if err := SetKeepAlive(client); err != nil {
+			mylog.Printf("TCP keepalive of %s: %v\n", client.RemoteAddr(), err)
+		}
+		atomic.AddUint64(&stats.accepted, 1)
+		go handleConnection(client, uint(atomic.AddUint64(&connection_count, 1)), stats)
 	}
-
 }
 
-func handleConnection(connection net.Conn, connectionID uint) {
-	mylog.Printf("Created NEW connection %s -> %s [ ID = %d ]\n", connection.LocalAddr(), connection.RemoteAddr(), connectionID)
+func handleConnection(client net.Conn, connectionID uint, stats *listenerStats) {
+	mylog.Printf("Created NEW connection %s -> %s [ ID = %d ]\n", client.LocalAddr(), client.RemoteAddr(), connectionID)
+	defer admission.ReleaseConnection()
+
+	atomic.AddInt64(&stats.active, 1)
+	defer atomic.AddInt64(&stats.active, -1)
+
+	connection := newServerConnection(client, connectionID)
+
+	connection_limit := admission.NewConnectionLimit()
+
+	// keep the raw bytes of the requests for the recording
+	var raw bytes.Buffer
+	counter := &byteCounter{Reader: client}
+	var reader io.Reader = counter
+	if requests_recorder != nil {
+		reader = io.TeeReader(counter, &raw)
+	}
 
 	for {
-		request, err := diam.ReadMessage(connection, dict.Default)
+		raw.Reset()
+		request, err := connection.ReadMessage(reader, counter)
 		if err != nil {
 			mylog.Println(err)
 			connection.Close()
@@ -50,19 +165,166 @@ func handleConnection(connection net.Conn, connectionID uint) {
 			return
 		}
 
-		if avp, err := request.FindAVP(avp.SessionID, 0); err == nil {
+		received := time.Now()
+		atomic.AddUint64(&stats.requests, 1)
 
-			switch avp.Data.(datatype.UTF8String) {
-			case datatype.UTF8String("test_send_message"), datatype.UTF8String("test_send_Multiple_message"):
-				mylog.Printf(" message: %s, from connectionID: %d\n", avp.Data.String(), connectionID)
+		// answer of a request pushed by the server
+		if request.Header.CommandFlags&diam.RequestFlag == 0 {
+			if request.Header.CommandCode == diam.DeviceWatchdog {
+				if result_code := resultCode(request); result_code != diam.Success {
+					connection.Close()
+					mylog.Printf("DWA with Result-Code %d, closed connection %s -> %s [ ID = %d ]\n", result_code, connection.LocalAddr(), connection.RemoteAddr(), connectionID)
+					return
+				}
+				mylog.Printf("DWA from connectionID: %d\n", connectionID)
 				continue
-			default:
-				response := request.Answer(200)
-				response.WriteTo(connection)
-				mylog.Printf("Responded %s to connectionID: %d\n", avp.Data.String(), connectionID)
 			}
+			if request.Header.CommandCode == diam.DisconnectPeer {
+				connection.Close()
+				mylog.Printf("DPA, closed connection %s -> %s [ ID = %d ]\n", connection.LocalAddr(), connection.RemoteAddr(), connectionID)
+				return
+			}
+			connection.HandleAnswer(request)
+			continue
+		}
+		if !connection.CheckPeer(request) {
+			connection.RejectPeer(request)
+			connection.Close()
+			mylog.Printf("Closed connection %s -> %s [ ID = %d ]\n", connection.LocalAddr(), connection.RemoteAddr(), connectionID)
+			return
+		}
+		if request.Header.CommandCode == diam.CapabilitiesExchange {
+			connection.WriteMessage(connection.CapabilitiesExchangeAnswer(request, diam.Success))
+			mylog.Printf("Capabilities exchanged with %s, Origin-Host %q of connectionID: %d\n", connection.RemoteAddr(), connection.origin_host, connectionID)
+			continue
+		}
+
+		connection.SetSessionID(request)
+		doic.Count()
+
+		if redirector.Handles(request) {
+			requests_recorder.Record(received, connectionID, true, raw.Bytes())
+			connection.WriteAnswer(request, redirector.Answer(request), received)
+			mylog.Printf("Redirected %s of connectionID: %d\n", sessionID(request), connectionID)
+			continue
+		}
+
+		if answer, duplicate := duplicates.Lookup(connection, request); duplicate {
+			requests_recorder.Record(received, connectionID, answer != nil, raw.Bytes())
+			total, retransmitted := duplicates.Counts()
+			mylog.Printf("Duplicate %s from connectionID: %d (total: %d duplicates, %d with T flag)\n", sessionID(request), connectionID, total, retransmitted)
+			if answer != nil {
+				connection.WriteMessage(answer)
+			}
+			continue
+		}
+
+		// Credit-Control-Requests of the online charging simulator
+		if ocs.Handles(request) {
+			requests_recorder.Record(received, connectionID, true, raw.Bytes())
+			if !admission.AdmitRequest(connection_limit) {
+				response := admit.TooBusyAnswer(request)
+				doic.Report(request, response)
+				connection.WriteAnswer(request, response, received)
+				duplicates.Release(connection, request)
+				mylog.Printf("Too busy, rejected %s from connectionID: %d\n", sessionID(request), connectionID)
+				continue
+			}
+			response := ocs.Answer(request)
+			doic.Report(request, response)
+			if err := connection.WriteAnswer(request, response, received); err == nil {
+				cdr_sink.Write(connection, request, response, received)
+			}
+			duplicates.Store(connection, request, response)
+			admission.DoneRequest()
+			continue
+		}
+
+		rule := CurrentRules().Evaluate(request)
+		requests_recorder.Record(received, connectionID, rule != nil && !rule.Answer.NoAnswer, raw.Bytes())
+		if rule == nil || rule.Answer.NoAnswer {
+			ack := connection.Acknowledge(request, received)
+			cdr_sink.Write(connection, request, ack, received)
+			duplicates.Store(connection, request, ack)
+			mylog.Printf(" message: %s, from connectionID: %d\n", sessionID(request), connectionID)
+			continue
 		}
 
+		if !admission.AdmitRequest(connection_limit) {
+			response := admit.TooBusyAnswer(request)
+			doic.Report(request, response)
+			connection.WriteAnswer(request, response, received)
+			duplicates.Release(connection, request)
+			mylog.Printf("Too busy, rejected %s from connectionID: %d\n", sessionID(request), connectionID)
+			continue
+		}
+		time.Sleep(rule.Answer.Delay)
+		response, err := rule.Answer.Build(request)
+		if err != nil {
+			mylog.Printf("Rule %q: %v\n", rule.Name, err)
+			duplicates.Release(connection, request)
+			admission.DoneRequest()
+			continue
+		}
+		doic.Report(request, response)
+		if err := connection.WriteAnswer(request, response, received); err == nil {
+			cdr_sink.Write(connection, request, response, received)
+		}
+		duplicates.Store(connection, request, response)
+		admission.DoneRequest()
+		mylog.Printf("Responded %s to connectionID: %d, rule %q\n", sessionID(request), connectionID, rule.Name)
+
 		time.Sleep(100 * time.Microsecond)
 	}
 }
+
+// ReloadOnSignal reloads the rules and the allowlist on SIGHUP, the current ones are kept if a file is invalid.
+func ReloadOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		if err := LoadRules(); err != nil {
+			mylog.Printf("Reload rules: %v\n", err)
+		}
+		if err := LoadAllowlist(); err != nil {
+			mylog.Printf("Reload allowlist: %v\n", err)
+		}
+	}
+}
+
+// shutdown functions, run on SIGINT/SIGTERM before the server exits
+var (
+	shutdown_mux   sync.Mutex
+	shutdown_funcs []func()
+)
+
+func OnShutdown(f func()) {
+	shutdown_mux.Lock()
+	defer shutdown_mux.Unlock()
+	shutdown_funcs = append(shutdown_funcs, f)
+}
+
+func ShutdownOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	mylog.Printf("Shutdown on %s\n", sig)
+	Shutdown()
+}
+
+// Shutdown runs the shutdown functions and exits.
+func Shutdown() {
+	shutdown_mux.Lock()
+	for _, f := range shutdown_funcs {
+		f()
+	}
+	shutdown_mux.Unlock()
+	os.Exit(0)
+}
+
+func sessionID(message *diam.Message) string {
+	if avp, err := message.FindAVP(avp.SessionID, 0); err == nil {
+		return AVPValueString(avp.Data)
+	}
+	return "<no Session-Id>"
+}
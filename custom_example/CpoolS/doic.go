@@ -0,0 +1,155 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+)
+
+// Diameter Overload Indication Conveyance (RFC 7683): the server measures its load in requests per second, and
+// the answers to the clients supporting DOIC carry an overload report with the reduction of the threshold reached.
+var (
+	doic_thresholds = flag.String("doic-thresholds", "", "Overload thresholds, requests per second:reduction percentage, comma separated (e.g. 500:20,1000:50), enables DOIC")
+	doic_validity   = flag.Duration("doic-validity", 30*time.Second, "OC-Validity-Duration of the overload reports")
+)
+
+const (
+	loss_algorithm = datatype.Unsigned64(1) // OLR_DEFAULT_ALGO of OC-Feature-Vector
+	host_report    = datatype.Enumerated(0) // HOST_REPORT of OC-Report-Type
+)
+
+type overloadThreshold struct {
+	load      float64 // requests per second
+	reduction uint32  // percentage
+}
+
+type overloadReporter struct {
+	thresholds []overloadThreshold // by load
+	requests   uint64              // received in the current second
+
+	mux       sync.Mutex
+	reduction uint32
+	sequence  uint64
+	ending    time.Time // the end of the overload is reported until then
+}
+
+// a nil *overloadReporter does not support DOIC
+var doic *overloadReporter
+
+func initOverloadControl() error {
+	if *doic_thresholds == "" {
+		return nil
+	}
+	thresholds, err := parseThresholds(*doic_thresholds)
+	if err != nil {
+		return fmt.Errorf("doic-thresholds: %v", err)
+	}
+	// a sequence number from the clock keeps increasing across restarts
+	doic = &overloadReporter{thresholds: thresholds, sequence: uint64(time.Now().Unix())}
+	go doic.MeasureForever()
+	mylog.Printf("DOIC enabled, %d thresholds\n", len(thresholds))
+	return nil
+}
+
+func parseThresholds(value string) ([]overloadThreshold, error) {
+	var thresholds []overloadThreshold
+	for _, field := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(field), ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%q is not load:reduction", field)
+		}
+		threshold := overloadThreshold{}
+		var err error
+		if threshold.load, err = strconv.ParseFloat(parts[0], 64); err != nil {
+			return nil, err
+		}
+		percentage, err := strconv.ParseUint(parts[1], 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		if percentage > 100 {
+			return nil, fmt.Errorf("reduction %d%% above 100%%", percentage)
+		}
+		threshold.reduction = uint32(percentage)
+		thresholds = append(thresholds, threshold)
+	}
+	sort.Slice(thresholds, func(i, j int) bool { return thresholds[i].load < thresholds[j].load })
+	return thresholds, nil
+}
+
+// Count counts a received request in the load.
+func (reporter *overloadReporter) Count() {
+	if reporter != nil {
+		atomic.AddUint64(&reporter.requests, 1)
+	}
+}
+
+// MeasureForever updates the reduction from the load of every second, a new reduction gets a new sequence number.
+func (reporter *overloadReporter) MeasureForever() {
+	for {
+		time.Sleep(time.Second)
+		load := float64(atomic.SwapUint64(&reporter.requests, 0))
+
+		var reduction uint32
+		for _, threshold := range reporter.thresholds {
+			if load >= threshold.load {
+				reduction = threshold.reduction
+			}
+		}
+
+		reporter.mux.Lock()
+		if reduction != reporter.reduction {
+			if reduction == 0 {
+				// the clients may keep the last report until its validity expires
+				reporter.ending = time.Now().Add(*doic_validity)
+			}
+			reporter.reduction = reduction
+			reporter.sequence++
+			mylog.Printf("DOIC: load %.0f requests/s, reduction %d%%, sequence %d\n", load, reduction, reporter.sequence)
+		}
+		reporter.mux.Unlock()
+	}
+}
+
+// Report adds OC-Supported-Features and the overload report to the answer, if the client supports DOIC.
+func (reporter *overloadReporter) Report(request, answer *diam.Message) {
+	if reporter == nil {
+		return
+	}
+	if _, err := request.FindAVP(avp.OCSupportedFeatures, 0); err != nil {
+		return
+	}
+	answer.NewAVP(avp.OCSupportedFeatures, 0, 0, &diam.GroupedAVP{
+		AVP: []*diam.AVP{diam.NewAVP(avp.OCFeatureVector, 0, 0, loss_algorithm)},
+	})
+
+	reporter.mux.Lock()
+	reduction, sequence, ending := reporter.reduction, reporter.sequence, reporter.ending
+	reporter.mux.Unlock()
+
+	validity := *doic_validity
+	if reduction == 0 {
+		if !time.Now().Before(ending) {
+			return
+		}
+		// OC-Validity-Duration 0 ends the overload
+		validity = 0
+	}
+	answer.NewAVP(avp.OCOLR, 0, 0, &diam.GroupedAVP{
+		AVP: []*diam.AVP{
+			diam.NewAVP(avp.OCSequenceNumber, 0, 0, datatype.Unsigned64(sequence)),
+			diam.NewAVP(avp.OCReportType, 0, 0, host_report),
+			diam.NewAVP(avp.OCReductionPercentage, 0, 0, datatype.Unsigned32(reduction)),
+			diam.NewAVP(avp.OCValidityDuration, 0, 0, datatype.Unsigned32(validity/time.Second)),
+		},
+	})
+}
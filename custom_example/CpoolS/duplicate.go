@@ -0,0 +1,205 @@
+package main
+
+import (
+	"container/list"
+	"flag"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+)
+
+// Duplicate request detection: the answers are kept by Origin-Host and End-to-End Identifier,
+// a duplicate request (retransmitted with the T flag) gets the answer sent before instead of being processed again.
+// A duplicate received while the original is processed, on another connection, is answered when the original is.
+var (
+	duplicate_cache_size = flag.Int("duplicate-cache-size", 0, "Max number of answers kept for the duplicate detection (0: disabled)")
+	duplicate_cache_ttl  = flag.Duration("duplicate-cache-ttl", 30*time.Second, "Time an answer is kept for the duplicate detection")
+)
+
+type duplicateKey struct {
+	origin_host string
+	end_to_end  uint32
+}
+
+type duplicateEntry struct {
+	key       duplicateKey
+	answer    *diam.Message // nil if the request was not answered
+	in_flight bool          // the original is processed
+	pending   []pendingDuplicate
+	expires   time.Time
+}
+
+// pendingDuplicate is a duplicate received while the original is processed, answered with the answer of the original.
+type pendingDuplicate struct {
+	connection *serverConnection
+	hop_by_hop uint32
+}
+
+type duplicateCache struct {
+	mux     sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[duplicateKey]*list.Element
+	order   *list.List // oldest first, so also by expiry time
+
+	// counters, for the stats
+	duplicates    uint64
+	retransmitted uint64 // duplicates with the T flag
+}
+
+// a nil *duplicateCache detects nothing
+var duplicates *duplicateCache
+
+func initDuplicateCache() {
+	if *duplicate_cache_size <= 0 {
+		return
+	}
+	duplicates = &duplicateCache{
+		size:    *duplicate_cache_size,
+		ttl:     *duplicate_cache_ttl,
+		entries: make(map[duplicateKey]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// newDuplicateKey identifies the request by its Origin-Host, or the IP address of the peer without Origin-Host:
+// a retransmission comes from another connection, so from another port.
+func newDuplicateKey(connection *serverConnection, request *diam.Message) duplicateKey {
+	key := duplicateKey{end_to_end: request.Header.EndToEndID}
+	if origin, err := request.FindAVP(avp.OriginHost, 0); err == nil {
+		key.origin_host = AVPValueString(origin.Data)
+	} else if host, _, err := net.SplitHostPort(connection.RemoteAddr().String()); err == nil {
+		key.origin_host = host
+	} else {
+		key.origin_host = connection.RemoteAddr().String()
+	}
+	return key
+}
+
+// remove drops the entry, its pending duplicates are dropped without answer. The caller holds the lock.
+func (cache *duplicateCache) remove(element *list.Element) {
+	entry := element.Value.(*duplicateEntry)
+	cache.order.Remove(element)
+	delete(cache.entries, entry.key)
+}
+
+// insert adds the entry, the oldest entries are dropped above the size of the cache. The caller holds the lock.
+func (cache *duplicateCache) insert(entry *duplicateEntry) {
+	if element, ok := cache.entries[entry.key]; ok {
+		cache.remove(element)
+	}
+	for cache.order.Len() >= cache.size {
+		cache.remove(cache.order.Front())
+	}
+	cache.entries[entry.key] = cache.order.PushBack(entry)
+}
+
+// removeExpired drops the expired entries, the caller holds the lock.
+func (cache *duplicateCache) removeExpired(now time.Time) {
+	for element := cache.order.Front(); element != nil; element = cache.order.Front() {
+		if now.Before(element.Value.(*duplicateEntry).expires) {
+			return
+		}
+		cache.remove(element)
+	}
+}
+
+// Lookup returns whether the request is a duplicate, and the answer sent to the original request
+// with the Hop-by-Hop Identifier of the duplicate (nil if the original was not answered).
+// A request which is not a duplicate is marked in flight: the caller must end its processing with Store or Release.
+// A duplicate of a request in flight returns at once without answer, it is answered by the Store of the original,
+// so it never blocks the read loop of its connection.
+func (cache *duplicateCache) Lookup(connection *serverConnection, request *diam.Message) (*diam.Message, bool) {
+	if cache == nil {
+		return nil, false
+	}
+	key := newDuplicateKey(connection, request)
+	now := time.Now()
+
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+
+	cache.removeExpired(now)
+	element, ok := cache.entries[key]
+	if !ok {
+		cache.insert(&duplicateEntry{key: key, in_flight: true, expires: now.Add(cache.ttl)})
+		return nil, false
+	}
+
+	cache.duplicates++
+	if request.Header.CommandFlags&diam.RetransmittedFlag != 0 {
+		cache.retransmitted++
+	}
+
+	entry := element.Value.(*duplicateEntry)
+	if entry.in_flight {
+		entry.pending = append(entry.pending, pendingDuplicate{connection: connection, hop_by_hop: request.Header.HopByHopID})
+		return nil, true
+	}
+	if entry.answer == nil {
+		return nil, true
+	}
+	return duplicateAnswer(entry.answer, request.Header.HopByHopID), true
+}
+
+// duplicateAnswer is a copy of the answer with the Hop-by-Hop Identifier of the duplicate.
+func duplicateAnswer(cached *diam.Message, hop_by_hop uint32) *diam.Message {
+	answer := *cached
+	header := *cached.Header
+	header.HopByHopID = hop_by_hop
+	answer.Header = &header
+	return &answer
+}
+
+// Store keeps the answer of a processed request, nil if it was not answered, and answers its pending duplicates.
+func (cache *duplicateCache) Store(connection *serverConnection, request, answer *diam.Message) {
+	if cache == nil {
+		return
+	}
+	key := newDuplicateKey(connection, request)
+	now := time.Now()
+
+	cache.mux.Lock()
+	var pending []pendingDuplicate
+	if element, ok := cache.entries[key]; ok && element.Value.(*duplicateEntry).in_flight {
+		pending = element.Value.(*duplicateEntry).pending
+	}
+	cache.removeExpired(now)
+	cache.insert(&duplicateEntry{key: key, answer: answer, expires: now.Add(cache.ttl)})
+	cache.mux.Unlock()
+
+	if answer == nil {
+		return
+	}
+	for _, duplicate := range pending {
+		if err := duplicate.connection.WriteMessage(duplicateAnswer(answer, duplicate.hop_by_hop)); err != nil {
+			mylog.Printf("Answer duplicate to connectionID: %d: %v\n", duplicate.connection.id, err)
+		}
+	}
+}
+
+// Release ends the processing of a request without answer to keep (rejected as too busy, ...),
+// so its next copy is processed. Its pending duplicates are dropped, the client retransmits them.
+func (cache *duplicateCache) Release(connection *serverConnection, request *diam.Message) {
+	if cache == nil {
+		return
+	}
+	key := newDuplicateKey(connection, request)
+
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+
+	if element, ok := cache.entries[key]; ok && element.Value.(*duplicateEntry).in_flight {
+		cache.remove(element)
+	}
+}
+
+// Counts returns the number of duplicates, and of duplicates with the T flag.
+func (cache *duplicateCache) Counts() (uint64, uint64) {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+	return cache.duplicates, cache.retransmitted
+}
@@ -0,0 +1,31 @@
+//go:build !windows
+
+package main
+
+import (
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// setKeepAliveProbes sets the interval and the number of the TCP keepalive probes, 0 keeps the system default.
+func setKeepAliveProbes(client *net.TCPConn, interval time.Duration, count int) error {
+	raw, err := client.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockopt_err error
+	err = raw.Control(func(fd uintptr) {
+		if interval > 0 {
+			sockopt_err = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_KEEPINTVL, int((interval+time.Second-1)/time.Second))
+		}
+		if sockopt_err == nil && count > 0 {
+			sockopt_err = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_KEEPCNT, count)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockopt_err
+}
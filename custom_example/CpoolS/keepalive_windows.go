@@ -0,0 +1,12 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// the interval of the keepalive probes is the idle time on Windows, and their number is fixed
+func setKeepAliveProbes(client *net.TCPConn, interval time.Duration, count int) error {
+	return errors.New("TCP keepalive interval and count are not supported on Windows")
+}
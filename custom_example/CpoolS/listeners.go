@@ -0,0 +1,28 @@
+package main
+
+import (
+	"flag"
+	"sync/atomic"
+	"time"
+)
+
+var num_listeners = flag.Int("listeners", 1, "Number of listeners on the port, with SO_REUSEPORT when more than 1, each with its own accept loop")
+
+// listenerStats are the counters of a listener and of its connections.
+type listenerStats struct {
+	id       int
+	accepted uint64
+	active   int64
+	requests uint64
+}
+
+// ListenerInfo prints the counters of every listener every second.
+func ListenerInfo(stats []*listenerStats) {
+	for {
+		for _, s := range stats {
+			mylog.Printf("listener %d: accepted %d, active %d, requests %d\n", s.id,
+				atomic.LoadUint64(&s.accepted), atomic.LoadInt64(&s.active), atomic.LoadUint64(&s.requests))
+		}
+		time.Sleep(time.Second)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+	"gopkg.in/yaml.v3"
+)
+
+var allowlist_file = flag.String("allowlist", "", "YAML file of the allowed peers (default: every peer), reloaded on SIGHUP")
+
+// Allowlist of the peers. An empty list allows any value, the Origin-Host and Origin-Realm are learned in the CER.
+// The connections from an address not allowed are closed when accepted, the requests of a peer not allowed are
+// answered with DIAMETER_UNKNOWN_PEER and the connection is closed. With Origin-Host or Origin-Realm rules,
+// the requests received before the CER are rejected, as with require_cer.
+//
+//	cidrs: [127.0.0.0/8, 10.0.0.0/8]
+//	origin_hosts: [client.test]
+//	origin_realms: [test]
+//	require_cer: true
+type Allowlist struct {
+	CIDRs        []string `yaml:"cidrs"`
+	OriginHosts  []string `yaml:"origin_hosts"`
+	OriginRealms []string `yaml:"origin_realms"`
+	RequireCER   bool     `yaml:"require_cer"` // reject the requests received before the CER, implied by the identity rules
+
+	networks []*net.IPNet
+}
+
+func ParseAllowlist(data []byte) (*Allowlist, error) {
+	allowlist := &Allowlist{}
+	if err := yaml.Unmarshal(data, allowlist); err != nil {
+		return nil, err
+	}
+	for _, cidr := range allowlist.CIDRs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		allowlist.networks = append(allowlist.networks, network)
+	}
+	return allowlist, nil
+}
+
+func (allowlist *Allowlist) AllowsAddress(address net.Addr) bool {
+	if len(allowlist.networks) == 0 {
+		return true
+	}
+	tcp_address, ok := address.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range allowlist.networks {
+		if network.Contains(tcp_address.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// RequiresCER reports whether the peer must send a CER before its requests: its identity is needed by the rules.
+func (allowlist *Allowlist) RequiresCER() bool {
+	return allowlist.RequireCER || len(allowlist.OriginHosts) > 0 || len(allowlist.OriginRealms) > 0
+}
+
+func (allowlist *Allowlist) AllowsIdentity(origin_host, origin_realm string) bool {
+	return contains(allowlist.OriginHosts, origin_host) && contains(allowlist.OriginRealms, origin_realm)
+}
+
+// contains reports whether the value is in the list, an empty list contains everything.
+func contains(list []string, value string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	allowlist_mux sync.RWMutex
+	allowlist     = &Allowlist{}
+)
+
+func CurrentAllowlist() *Allowlist {
+	allowlist_mux.RLock()
+	defer allowlist_mux.RUnlock()
+	return allowlist
+}
+
+// LoadAllowlist loads the allowlist file, without file every peer is allowed.
+func LoadAllowlist() error {
+	loaded := &Allowlist{}
+	if *allowlist_file != "" {
+		data, err := os.ReadFile(*allowlist_file)
+		if err != nil {
+			return err
+		}
+		if loaded, err = ParseAllowlist(data); err != nil {
+			return fmt.Errorf("%s: %v", *allowlist_file, err)
+		}
+		mylog.Printf("Loaded allowlist: %d CIDR, %d Origin-Host, %d Origin-Realm\n",
+			len(loaded.CIDRs), len(loaded.OriginHosts), len(loaded.OriginRealms))
+	}
+
+	allowlist_mux.Lock()
+	allowlist = loaded
+	allowlist_mux.Unlock()
+	return nil
+}
+
+// CheckPeer reports whether the peer of the connection may send this request, with the allowlist of now
+// (reloaded since the connection was accepted). A CER sets the identity of the peer.
+func (c *serverConnection) CheckPeer(request *diam.Message) bool {
+	allowlist := CurrentAllowlist()
+	if !allowlist.AllowsAddress(c.RemoteAddr()) {
+		return false
+	}
+
+	if request.Header.CommandCode == diam.CapabilitiesExchange {
+		c.origin_host, c.origin_realm = "", ""
+		if origin, err := request.FindAVP(avp.OriginHost, 0); err == nil {
+			c.origin_host = AVPValueString(origin.Data)
+		}
+		if origin, err := request.FindAVP(avp.OriginRealm, 0); err == nil {
+			c.origin_realm = AVPValueString(origin.Data)
+		}
+		c.capabilities_exchanged = true
+	} else if !c.capabilities_exchanged {
+		return !allowlist.RequiresCER()
+	}
+	return allowlist.AllowsIdentity(c.origin_host, c.origin_realm)
+}
+
+// RejectPeer answers DIAMETER_UNKNOWN_PEER to the request, the caller closes the connection.
+func (c *serverConnection) RejectPeer(request *diam.Message) {
+	var answer *diam.Message
+	if request.Header.CommandCode == diam.CapabilitiesExchange {
+		answer = c.CapabilitiesExchangeAnswer(request, diam.UnknownPeer)
+	} else {
+		answer = request.Answer(diam.UnknownPeer)
+	}
+	answer.Header.CommandFlags |= diam.ErrorFlag
+	c.WriteMessage(answer)
+	mylog.Printf("Rejected unknown peer %s (Origin-Host %q, Origin-Realm %q) of connectionID: %d\n",
+		c.RemoteAddr(), c.origin_host, c.origin_realm, c.id)
+}
+
+// CapabilitiesExchangeAnswer builds the CEA of the server.
+func (c *serverConnection) CapabilitiesExchangeAnswer(request *diam.Message, result_code uint32) *diam.Message {
+	answer := request.Answer(result_code)
+	answer.NewAVP(avp.OriginHost, avp.Mbit, 0, origin_host)
+	answer.NewAVP(avp.OriginRealm, avp.Mbit, 0, origin_realm)
+	if local, ok := c.LocalAddr().(*net.TCPAddr); ok {
+		ip := local.IP
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		answer.NewAVP(avp.HostIPAddress, avp.Mbit, 0, datatype.Address(ip))
+	}
+	answer.NewAVP(avp.VendorID, avp.Mbit, 0, datatype.Unsigned32(0))
+	answer.NewAVP(avp.ProductName, 0, 0, datatype.UTF8String("CpoolS"))
+	return answer
+}
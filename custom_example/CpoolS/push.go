@@ -0,0 +1,201 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+)
+
+// Server-initiated requests: the server pushes Re-Auth-Request or Abort-Session-Request to the connected clients,
+// every push-interval and on SIGUSR1.
+var (
+	push_interval = flag.Duration("push-interval", 0, "Interval of the server-initiated requests to every connection (0: only on SIGUSR1)")
+	push_command  = flag.String("push-command", "RAR", "Server-initiated request: RAR (Re-Auth-Request) or ASR (Abort-Session-Request)")
+	push_timeout  = flag.Duration("push-timeout", 30*time.Second, "Time a pushed request waits for its answer before it is forgotten")
+)
+
+const (
+	origin_host  = datatype.DiameterIdentity("cpools.test")
+	origin_realm = datatype.DiameterIdentity("test")
+)
+
+// serverConnection is a client connection of the server. The answers of the handleConnection loop and
+// the pushed requests are written concurrently, so every write goes through WriteMessage.
+type serverConnection struct {
+	net.Conn
+	id uint
+
+	write_mux sync.Mutex
+
+	mux        sync.Mutex
+	session_id datatype.UTF8String  // last Session-Id received, used by the pushed requests
+	pushed     map[uint32]time.Time // Hop-by-Hop ID -> sent time, of the pushed requests waiting for an answer
+
+	draining int32 // set by DisconnectPeer, read atomically
+
+	// identity of the peer learned in the CER, used by the read loop only
+	capabilities_exchanged bool
+	origin_host            string
+	origin_realm           string
+}
+
+var (
+	connections_mux sync.Mutex
+	connections     = make(map[uint]*serverConnection)
+)
+
+func newServerConnection(connection net.Conn, connectionID uint) *serverConnection {
+	server_connection := &serverConnection{Conn: connection, id: connectionID, pushed: make(map[uint32]time.Time)}
+	connections_mux.Lock()
+	connections[connectionID] = server_connection
+	connections_mux.Unlock()
+	return server_connection
+}
+
+func (c *serverConnection) Close() error {
+	connections_mux.Lock()
+	delete(connections, c.id)
+	connections_mux.Unlock()
+	return c.Conn.Close()
+}
+
+func (c *serverConnection) WriteMessage(message *diam.Message) error {
+	c.write_mux.Lock()
+	defer c.write_mux.Unlock()
+	_, err := message.WriteTo(c.Conn)
+	return err
+}
+
+// SetSessionID keeps the Session-Id of the last request of the client.
+func (c *serverConnection) SetSessionID(request *diam.Message) {
+	if session, err := request.FindAVP(avp.SessionID, 0); err == nil {
+		if session_id, ok := session.Data.(datatype.UTF8String); ok {
+			c.mux.Lock()
+			c.session_id = session_id
+			c.mux.Unlock()
+		}
+	}
+}
+
+// Push sends a server-initiated request to the client, its answer is passed to HandleAnswer by the read loop.
+func (c *serverConnection) Push(command string) error {
+	c.mux.Lock()
+	session_id := c.session_id
+	c.mux.Unlock()
+	if session_id == "" {
+		session_id = datatype.UTF8String(fmt.Sprintf("cpools.test;push;%d", c.id))
+	}
+
+	var request *diam.Message
+	switch strings.ToUpper(command) {
+	case diam.RAR:
+		request = diam.NewRequest(diam.ReAuth, 0, nil)
+		request.NewAVP(avp.SessionID, avp.Mbit, 0, session_id)
+		request.NewAVP(avp.OriginHost, avp.Mbit, 0, origin_host)
+		request.NewAVP(avp.OriginRealm, avp.Mbit, 0, origin_realm)
+		request.NewAVP(avp.DestinationRealm, avp.Mbit, 0, origin_realm)
+		request.NewAVP(avp.AuthApplicationID, avp.Mbit, 0, datatype.Unsigned32(0))
+		request.NewAVP(avp.ReAuthRequestType, avp.Mbit, 0, datatype.Enumerated(0)) // AUTHORIZE_ONLY
+	case diam.ASR:
+		request = diam.NewRequest(diam.AbortSession, 0, nil)
+		request.NewAVP(avp.SessionID, avp.Mbit, 0, session_id)
+		request.NewAVP(avp.OriginHost, avp.Mbit, 0, origin_host)
+		request.NewAVP(avp.OriginRealm, avp.Mbit, 0, origin_realm)
+		request.NewAVP(avp.DestinationRealm, avp.Mbit, 0, origin_realm)
+		request.NewAVP(avp.AuthApplicationID, avp.Mbit, 0, datatype.Unsigned32(0))
+	default:
+		return fmt.Errorf("unknown push command %q", command)
+	}
+
+	c.mux.Lock()
+	c.expirePushed()
+	c.pushed[request.Header.HopByHopID] = time.Now()
+	c.mux.Unlock()
+
+	if err := c.WriteMessage(request); err != nil {
+		c.mux.Lock()
+		delete(c.pushed, request.Header.HopByHopID)
+		c.mux.Unlock()
+		return err
+	}
+	mylog.Printf("Pushed %s %s to connectionID: %d\n", strings.ToUpper(command), session_id, c.id)
+	return nil
+}
+
+// expirePushed forgets the pushed requests not answered within push-timeout. The caller holds c.mux.
+func (c *serverConnection) expirePushed() {
+	for hop_by_hop, sent := range c.pushed {
+		if time.Since(sent) > *push_timeout {
+			delete(c.pushed, hop_by_hop)
+			mylog.Printf("No answer of pushed request (Hop-by-Hop ID %#x) from connectionID: %d in %s\n", hop_by_hop, c.id, *push_timeout)
+		}
+	}
+}
+
+// HandleAnswer receives the answer of a pushed request.
+func (c *serverConnection) HandleAnswer(answer *diam.Message) {
+	c.mux.Lock()
+	sent, ok := c.pushed[answer.Header.HopByHopID]
+	delete(c.pushed, answer.Header.HopByHopID)
+	c.expirePushed()
+	c.mux.Unlock()
+
+	if !ok {
+		mylog.Printf("Unexpected answer (Hop-by-Hop ID %#x) from connectionID: %d\n", answer.Header.HopByHopID, c.id)
+		return
+	}
+
+	result := "<no Result-Code>"
+	if result_code, err := answer.FindAVP(avp.ResultCode, 0); err == nil {
+		result = AVPValueString(result_code.Data)
+	}
+	mylog.Printf("Answer of pushed request from connectionID: %d, Result-Code: %s, in %s\n", c.id, result, time.Since(sent))
+}
+
+// PushAll sends a server-initiated request to every connection.
+func PushAll(command string) {
+	connections_mux.Lock()
+	all := make([]*serverConnection, 0, len(connections))
+	for _, c := range connections {
+		all = append(all, c)
+	}
+	connections_mux.Unlock()
+
+	for _, c := range all {
+		if err := c.Push(command); err != nil {
+			mylog.Printf("Push to connectionID: %d: %v\n", c.id, err)
+		}
+	}
+}
+
+// PushForever pushes the requests every push-interval and on SIGUSR1.
+func PushForever() {
+	signals := make(chan os.Signal, 1)
+	if len(push_signals) > 0 {
+		signal.Notify(signals, push_signals...)
+	}
+
+	var tick <-chan time.Time
+	if *push_interval > 0 {
+		ticker := time.NewTicker(*push_interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-signals:
+		case <-tick:
+		}
+		PushAll(*push_command)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"sync"
+	"time"
+
+	"common/recording"
+)
+
+var record_file = flag.String("record", "", "Record every received request to this file (JSON lines), for replay by the client")
+
+type recorder struct {
+	mux    sync.Mutex
+	file   *os.File
+	writer *recording.Writer
+}
+
+// a nil *recorder records nothing
+var requests_recorder *recorder
+
+func initRecorder() error {
+	if *record_file == "" {
+		return nil
+	}
+	file, err := os.OpenFile(*record_file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	requests_recorder = &recorder{file: file, writer: recording.NewWriter(file)}
+	mylog.Printf("Recording requests to %s\n", *record_file)
+	return nil
+}
+
+// Record writes the request to the recording.
+func (r *recorder) Record(received time.Time, connectionID uint, answered bool, raw []byte) {
+	if r == nil {
+		return
+	}
+
+	record := recording.Record{
+		Time:         received,
+		ConnectionID: connectionID,
+		Answered:     answered,
+		Message:      raw,
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if err := r.writer.Write(&record); err != nil {
+		mylog.Printf("Record: %v\n", err)
+	}
+}
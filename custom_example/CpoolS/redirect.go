@@ -0,0 +1,91 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"common/vendordict"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+)
+
+// Redirect agent: every request is answered with DIAMETER_REDIRECT_INDICATION and the hosts the client must send it to,
+// except the one-way messages: their sender does not read the answers.
+var (
+	redirect_hosts      = flag.String("redirect-hosts", "", "Answer every request with 3006 DIAMETER_REDIRECT_INDICATION to these Diameter URIs, comma separated (e.g. aaa://127.0.0.1:8081)")
+	redirect_usage      = flag.String("redirect-usage", "DONT_CACHE", "Redirect-Host-Usage: DONT_CACHE, ALL_SESSION, ALL_REALM, REALM_AND_APPLICATION, ALL_APPLICATION, ALL_HOST or ALL_USER")
+	redirect_cache_time = flag.Duration("redirect-cache-time", time.Minute, "Redirect-Max-Cache-Time of the redirects")
+)
+
+// values of Redirect-Host-Usage
+var redirect_usages = []string{"DONT_CACHE", "ALL_SESSION", "ALL_REALM", "REALM_AND_APPLICATION", "ALL_APPLICATION", "ALL_HOST", "ALL_USER"}
+
+type redirectAgent struct {
+	hosts []datatype.DiameterURI
+	usage datatype.Enumerated
+}
+
+// a nil *redirectAgent redirects nothing
+var redirector *redirectAgent
+
+func initRedirect() error {
+	if *redirect_hosts == "" {
+		return nil
+	}
+	agent := &redirectAgent{usage: -1}
+	for i, usage := range redirect_usages {
+		if strings.EqualFold(*redirect_usage, usage) {
+			agent.usage = datatype.Enumerated(i)
+		}
+	}
+	if agent.usage < 0 {
+		return fmt.Errorf("unknown Redirect-Host-Usage %q", *redirect_usage)
+	}
+	for _, host := range strings.Split(*redirect_hosts, ",") {
+		agent.hosts = append(agent.hosts, datatype.DiameterURI(strings.TrimSpace(host)))
+	}
+	redirector = agent
+	mylog.Printf("Redirecting the requests to %s, %s\n", *redirect_hosts, redirect_usages[agent.usage])
+	return nil
+}
+
+// Handles reports whether the request is redirected: its sender reads the answer.
+func (agent *redirectAgent) Handles(request *diam.Message) bool {
+	return agent != nil && expectsAnswer(request)
+}
+
+// expectsAnswer reports whether the sender of the request reads its answer: the requests of the charging simulator,
+// the one-way messages asking for an acknowledgment, and the requests answered by the rules.
+func expectsAnswer(request *diam.Message) bool {
+	if ocs.Handles(request) {
+		return true
+	}
+	if _, err := request.FindAVP(vendordict.DeliveryID, vendordict.VendorID); err == nil {
+		return true
+	}
+	rule := CurrentRules().Evaluate(request)
+	return rule != nil && !rule.Answer.NoAnswer
+}
+
+// Answer builds the redirect answer of the request.
+func (agent *redirectAgent) Answer(request *diam.Message) *diam.Message {
+	answer := request.Answer(diam.RedirectIndication)
+	answer.Header.CommandFlags |= diam.ErrorFlag
+	if session_id, err := request.FindAVP(avp.SessionID, 0); err == nil {
+		answer.InsertAVP(session_id)
+	}
+	answer.NewAVP(avp.OriginHost, avp.Mbit, 0, origin_host)
+	answer.NewAVP(avp.OriginRealm, avp.Mbit, 0, origin_realm)
+	for _, host := range agent.hosts {
+		answer.NewAVP(avp.RedirectHost, avp.Mbit, 0, host)
+	}
+	answer.NewAVP(avp.RedirectHostUsage, avp.Mbit, 0, agent.usage)
+	if agent.usage != 0 {
+		answer.NewAVP(avp.RedirectMaxCacheTime, avp.Mbit, 0, datatype.Unsigned32(*redirect_cache_time/time.Second))
+	}
+	return answer
+}
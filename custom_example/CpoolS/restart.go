@@ -0,0 +1,224 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"common/reuseport"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+)
+
+// Hot restart: on SIGUSR2 the server starts a new process of its binary with the same arguments and passes it
+// the listening sockets. Once the new process reports it is ready, the old one stops accepting and drains its
+// connections, and the new process accepts the new connections.
+var (
+	drain_timeout = flag.Duration("drain-timeout", 30*time.Second, "Max time to drain the connections after a hot restart, the remaining connections are closed")
+	drain_idle    = flag.Duration("drain-idle", 2*time.Second, "Close a connection idle for this time after the DPR of a hot restart, if the client sends no DPA")
+	ready_timeout = flag.Duration("ready-timeout", 10*time.Second, "Max time the new process of a hot restart takes to be ready, it is killed after")
+)
+
+// listener_fds_env tells the new process the file descriptors of the inherited listening sockets,
+// ready_fd_env the pipe it writes to once it accepts the connections
+const (
+	listener_fds_env = "CPOOLS_LISTENER_FDS"
+	ready_fd_env     = "CPOOLS_READY_FD"
+)
+
+// Listen opens the listening sockets, or takes the ones inherited from the previous process.
+func Listen(bind_address *net.TCPAddr, n int) ([]*net.TCPListener, error) {
+	if os.Getenv(listener_fds_env) == "" {
+		return reuseport.Listen(bind_address, n)
+	}
+
+	var listeners []*net.TCPListener
+	for _, value := range strings.Split(os.Getenv(listener_fds_env), ",") {
+		fd, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			reuseport.Close(listeners)
+			return nil, fmt.Errorf("%s: %v", listener_fds_env, err)
+		}
+		file := os.NewFile(uintptr(fd), "listener")
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			reuseport.Close(listeners)
+			return nil, err
+		}
+		tcp_listener, ok := listener.(*net.TCPListener)
+		if !ok {
+			listener.Close()
+			reuseport.Close(listeners)
+			return nil, fmt.Errorf("inherited listener is not TCP")
+		}
+		listeners = append(listeners, tcp_listener)
+	}
+	mylog.Printf("Inherited %d listeners from the previous process\n", len(listeners))
+	return listeners, nil
+}
+
+// RestartOnSignal starts the new process on SIGUSR2, and once it is ready closes the listeners, so the accept loops
+// return and the connections are drained. The old process stops rotating the CDR file, the new one owns it.
+func RestartOnSignal(listeners []*net.TCPListener) {
+	if len(restart_signals) == 0 {
+		return
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, restart_signals...)
+
+	for range signals {
+		if err := startNewProcess(listeners); err != nil {
+			mylog.Printf("Hot restart: %v\n", err)
+			continue
+		}
+		cdr_sink.HandOff()
+		reuseport.Close(listeners)
+		return
+	}
+}
+
+func startNewProcess(listeners []*net.TCPListener) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	// ExtraFiles[i] is the file descriptor 3+i of the new process
+	files := make([]*os.File, 0, len(listeners))
+	fds := make([]string, 0, len(listeners))
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	for i, listener := range listeners {
+		file, err := listener.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, file)
+		fds = append(fds, strconv.Itoa(3+i))
+	}
+
+	// the new process writes to the pipe when it is ready, it is closed without write if the process fails
+	ready, ready_writer, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+	files = append(files, ready_writer)
+
+	process := exec.Command(executable, os.Args[1:]...)
+	process.Env = append(os.Environ(),
+		listener_fds_env+"="+strings.Join(fds, ","),
+		ready_fd_env+"="+strconv.Itoa(3+len(listeners)))
+	process.ExtraFiles = files
+	process.Stdout = os.Stdout
+	process.Stderr = os.Stderr
+	if err := process.Start(); err != nil {
+		return err
+	}
+	ready_writer.Close()
+	mylog.Printf("Hot restart: started new process, pid %d\n", process.Process.Pid)
+
+	ready.SetReadDeadline(time.Now().Add(*ready_timeout))
+	if _, err := ready.Read(make([]byte, 1)); err != nil {
+		process.Process.Kill()
+		process.Wait()
+		return fmt.Errorf("new process not ready: %v", err)
+	}
+	go process.Wait()
+	mylog.Printf("Hot restart: new process ready, pid %d\n", process.Process.Pid)
+	return nil
+}
+
+// NotifyReady tells the previous process of a hot restart that this process accepts the connections.
+func NotifyReady() {
+	if os.Getenv(ready_fd_env) == "" {
+		return
+	}
+	fd, err := strconv.ParseUint(os.Getenv(ready_fd_env), 10, 32)
+	if err != nil {
+		mylog.Printf("%s: %v\n", ready_fd_env, err)
+		return
+	}
+	ready := os.NewFile(uintptr(fd), "ready")
+	if _, err := ready.Write([]byte{1}); err != nil {
+		mylog.Printf("Notify ready: %v\n", err)
+	}
+	ready.Close()
+}
+
+// DrainConnections sends a Disconnect-Peer-Request on every connection, then waits until every connection is closed:
+// by the DPA of its client, once the request in process is answered, or after drain-idle without request.
+// The remaining connections are closed after the timeout.
+func DrainConnections(timeout time.Duration) {
+	connections_mux.Lock()
+	draining := make([]*serverConnection, 0, len(connections))
+	for _, c := range connections {
+		draining = append(draining, c)
+	}
+	connections_mux.Unlock()
+	for _, c := range draining {
+		if err := c.DisconnectPeer(); err != nil {
+			mylog.Printf("DPR to connectionID: %d: %v\n", c.id, err)
+		}
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		connections_mux.Lock()
+		remaining := len(connections)
+		connections_mux.Unlock()
+
+		if remaining == 0 {
+			mylog.Println("Drained all connections")
+			return
+		}
+		if time.Now().After(deadline) {
+			break
+		}
+		mylog.Printf("Draining %d connections\n", remaining)
+		time.Sleep(time.Second)
+	}
+
+	connections_mux.Lock()
+	remaining := make([]*serverConnection, 0, len(connections))
+	for _, c := range connections {
+		remaining = append(remaining, c)
+	}
+	connections_mux.Unlock()
+
+	mylog.Printf("Drain timeout, closing %d connections\n", len(remaining))
+	for _, c := range remaining {
+		c.Close()
+	}
+}
+
+// DisconnectPeer sends a Disconnect-Peer-Request (REBOOTING) to the client, and wakes up the read loop
+// so it closes the connection once idle.
+func (c *serverConnection) DisconnectPeer() error {
+	atomic.StoreInt32(&c.draining, 1)
+	c.SetReadDeadline(time.Now())
+
+	request := diam.NewRequest(diam.DisconnectPeer, 0, nil)
+	request.NewAVP(avp.OriginHost, avp.Mbit, 0, origin_host)
+	request.NewAVP(avp.OriginRealm, avp.Mbit, 0, origin_realm)
+	request.NewAVP(avp.DisconnectCause, avp.Mbit, 0, datatype.Enumerated(0)) // REBOOTING
+	return c.WriteMessage(request)
+}
+
+// Draining reports whether DisconnectPeer was called.
+func (c *serverConnection) Draining() bool {
+	return atomic.LoadInt32(&c.draining) != 0
+}
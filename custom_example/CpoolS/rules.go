@@ -0,0 +1,321 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+	"gopkg.in/yaml.v3"
+)
+
+var rules_file = flag.String("rules", "", "YAML file of the scripted answers (default: built-in rules), reloaded on SIGHUP")
+
+// Rules are evaluated in order, the first rule matching a request decides the answer.
+// A request matching no rule is not answered.
+//
+//	rules:
+//	  - name: slow CCR
+//	    match:
+//	      command_code: 272
+//	      application_id: 4
+//	      avps:
+//	        - avp: Session-Id
+//	          regex: "^ccr_"
+//	    answer:
+//	      result_code: 2001
+//	      delay: 200ms
+//	      avps:
+//	        - avp: Origin-Host
+//	          value: test.server
+//	  - name: one-way messages
+//	    match:
+//	      avps:
+//	        - avp: Session-Id
+//	          value: test_send_message
+//	    answer:
+//	      no_answer: true
+type RuleSet struct {
+	Rules []*Rule `yaml:"rules"`
+}
+
+type Rule struct {
+	Name   string     `yaml:"name"`
+	Match  RuleMatch  `yaml:"match"`
+	Answer RuleAnswer `yaml:"answer"`
+}
+
+// RuleMatch is the condition of a rule, all the configured fields must match.
+type RuleMatch struct {
+	CommandCode   *uint32     `yaml:"command_code"`
+	ApplicationID *uint32     `yaml:"application_id"`
+	AVPs          []*AVPMatch `yaml:"avps"`
+}
+
+// AVPMatch matches an AVP of the request by its literal value or by a regular expression.
+// Without value and regex, the AVP only needs to be present.
+type AVPMatch struct {
+	AVP      string  `yaml:"avp"` // name in the dictionary or code
+	VendorID uint32  `yaml:"vendor_id"`
+	Value    *string `yaml:"value"`
+	Regex    string  `yaml:"regex"`
+
+	regex *regexp.Regexp
+}
+
+type RuleAnswer struct {
+	NoAnswer   bool          `yaml:"no_answer"`
+	ResultCode uint32        `yaml:"result_code"`
+	Delay      time.Duration `yaml:"delay"`
+	AVPs       []*AVPValue   `yaml:"avps"` // extra AVPs added to the answer
+}
+
+type AVPValue struct {
+	AVP      string `yaml:"avp"` // name in the dictionary or code
+	VendorID uint32 `yaml:"vendor_id"`
+	Value    string `yaml:"value"`
+}
+
+// defaultRules keeps the behaviour of the server without rules file:
+// the one-way test messages are not answered, the other requests are answered with Result-Code 200.
+func defaultRules() *RuleSet {
+	one_way := `^(test_send_message|test_send_Multiple_message)$`
+	rules, _ := NewRuleSet(&RuleSet{Rules: []*Rule{
+		{
+			Name:   "one-way test messages",
+			Match:  RuleMatch{AVPs: []*AVPMatch{{AVP: "Session-Id", Regex: one_way}}},
+			Answer: RuleAnswer{NoAnswer: true},
+		},
+		{
+			Name:   "requests",
+			Match:  RuleMatch{AVPs: []*AVPMatch{{AVP: "Session-Id"}}},
+			Answer: RuleAnswer{ResultCode: 200},
+		},
+	}})
+	return rules
+}
+
+// ParseRules decodes and validates a YAML rules document.
+func ParseRules(data []byte) (*RuleSet, error) {
+	rules := &RuleSet{}
+	if err := yaml.Unmarshal(data, rules); err != nil {
+		return nil, err
+	}
+	return NewRuleSet(rules)
+}
+
+// NewRuleSet validates the rules and compiles their regular expressions.
+func NewRuleSet(rules *RuleSet) (*RuleSet, error) {
+	for i, rule := range rules.Rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule_%d", i+1)
+		}
+		for _, match := range rule.Match.AVPs {
+			if match.AVP == "" {
+				return nil, fmt.Errorf("rule %q: match of AVP without name or code", rule.Name)
+			}
+			if match.Regex != "" {
+				regex, err := regexp.Compile(match.Regex)
+				if err != nil {
+					return nil, fmt.Errorf("rule %q: %v", rule.Name, err)
+				}
+				match.regex = regex
+			}
+		}
+		if !rule.Answer.NoAnswer && rule.Answer.ResultCode == 0 {
+			return nil, fmt.Errorf("rule %q: answer without result_code", rule.Name)
+		}
+		for _, value := range rule.Answer.AVPs {
+			if value.AVP == "" {
+				return nil, fmt.Errorf("rule %q: answer AVP without name or code", rule.Name)
+			}
+		}
+	}
+	return rules, nil
+}
+
+// Evaluate returns the first rule matching the request, or nil.
+func (rules *RuleSet) Evaluate(request *diam.Message) *Rule {
+	for _, rule := range rules.Rules {
+		if rule.Match.Matches(request) {
+			return rule
+		}
+	}
+	return nil
+}
+
+func (match *RuleMatch) Matches(request *diam.Message) bool {
+	if match.CommandCode != nil && *match.CommandCode != request.Header.CommandCode {
+		return false
+	}
+	if match.ApplicationID != nil && *match.ApplicationID != request.Header.ApplicationID {
+		return false
+	}
+	for _, avp_match := range match.AVPs {
+		if !avp_match.Matches(request) {
+			return false
+		}
+	}
+	return true
+}
+
+func (match *AVPMatch) Matches(request *diam.Message) bool {
+	found, err := request.FindAVPs(avpCode(match.AVP), match.VendorID)
+	if err != nil || len(found) == 0 {
+		return false
+	}
+	if match.Value == nil && match.regex == nil {
+		return true
+	}
+	for _, a := range found {
+		value := AVPValueString(a.Data)
+		if match.Value != nil && *match.Value != value {
+			continue
+		}
+		if match.regex != nil && !match.regex.MatchString(value) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// Build creates the answer of the request, the delay is left to the caller.
+func (answer *RuleAnswer) Build(request *diam.Message) (*diam.Message, error) {
+	response := request.Answer(answer.ResultCode)
+	for _, value := range answer.AVPs {
+		dict_avp, err := request.Dictionary().FindAVPWithVendor(request.Header.ApplicationID, avpCode(value.AVP), value.VendorID)
+		if err != nil {
+			return nil, err
+		}
+		data, err := ParseAVPValue(dict_avp.Data.Type, value.Value)
+		if err != nil {
+			return nil, fmt.Errorf("AVP %s: %v", value.AVP, err)
+		}
+		flags := uint8(avp.Mbit)
+		if value.VendorID != 0 {
+			flags |= avp.Vbit
+		}
+		response.NewAVP(dict_avp.Code, flags, value.VendorID, data)
+	}
+	return response, nil
+}
+
+// avpCode converts the AVP of a rule to the code argument of the dictionary functions.
+func avpCode(name string) interface{} {
+	if code, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint32(code)
+	}
+	return name
+}
+
+// AVPValueString returns the value of the AVP data as it is written in the rules.
+func AVPValueString(data datatype.Type) string {
+	switch value := data.(type) {
+	case datatype.UTF8String:
+		return string(value)
+	case datatype.OctetString:
+		return string(value)
+	case datatype.DiameterIdentity:
+		return string(value)
+	case datatype.DiameterURI:
+		return string(value)
+	case datatype.Unsigned32:
+		return strconv.FormatUint(uint64(value), 10)
+	case datatype.Unsigned64:
+		return strconv.FormatUint(uint64(value), 10)
+	case datatype.Integer32:
+		return strconv.FormatInt(int64(value), 10)
+	case datatype.Integer64:
+		return strconv.FormatInt(int64(value), 10)
+	case datatype.Enumerated:
+		return strconv.FormatInt(int64(value), 10)
+	case datatype.Address:
+		return net.IP(value).String()
+	case datatype.Time:
+		return time.Time(value).UTC().Format(time.RFC3339)
+	default:
+		return data.String()
+	}
+}
+
+// ParseAVPValue converts the value of a rule to the AVP data type.
+func ParseAVPValue(typ datatype.TypeID, value string) (datatype.Type, error) {
+	switch typ {
+	case datatype.UTF8StringType:
+		return datatype.UTF8String(value), nil
+	case datatype.OctetStringType:
+		return datatype.OctetString(value), nil
+	case datatype.DiameterIdentityType:
+		return datatype.DiameterIdentity(value), nil
+	case datatype.DiameterURIType:
+		return datatype.DiameterURI(value), nil
+	case datatype.Unsigned32Type:
+		n, err := strconv.ParseUint(value, 10, 32)
+		return datatype.Unsigned32(n), err
+	case datatype.Unsigned64Type:
+		n, err := strconv.ParseUint(value, 10, 64)
+		return datatype.Unsigned64(n), err
+	case datatype.Integer32Type:
+		n, err := strconv.ParseInt(value, 10, 32)
+		return datatype.Integer32(n), err
+	case datatype.Integer64Type:
+		n, err := strconv.ParseInt(value, 10, 64)
+		return datatype.Integer64(n), err
+	case datatype.EnumeratedType:
+		n, err := strconv.ParseInt(value, 10, 32)
+		return datatype.Enumerated(n), err
+	case datatype.AddressType:
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %q", value)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		return datatype.Address(ip), nil
+	case datatype.TimeType:
+		t, err := time.Parse(time.RFC3339, value)
+		return datatype.Time(t), err
+	default:
+		return nil, fmt.Errorf("unsupported data type %d", typ)
+	}
+}
+
+var (
+	rules_mux sync.RWMutex
+	rules     *RuleSet
+)
+
+func CurrentRules() *RuleSet {
+	rules_mux.RLock()
+	defer rules_mux.RUnlock()
+	return rules
+}
+
+// LoadRules loads the rules file, or the built-in rules without file.
+func LoadRules() error {
+	loaded := defaultRules()
+	if *rules_file != "" {
+		data, err := os.ReadFile(*rules_file)
+		if err != nil {
+			return err
+		}
+		if loaded, err = ParseRules(data); err != nil {
+			return fmt.Errorf("%s: %v", *rules_file, err)
+		}
+	}
+
+	rules_mux.Lock()
+	rules = loaded
+	rules_mux.Unlock()
+	mylog.Printf("Loaded %d rules\n", len(loaded.Rules))
+	return nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+	"github.com/fiorix/go-diameter/v4/diam/dict"
+)
+
+func newTestRequest(command_code, application_id uint32, session_id string) *diam.Message {
+	request := diam.NewRequest(command_code, application_id, dict.Default)
+	if session_id != "" {
+		request.NewAVP(avp.SessionID, avp.Mbit, 0, datatype.UTF8String(session_id))
+	}
+	request.NewAVP(avp.OriginHost, avp.Mbit, 0, datatype.DiameterIdentity("test.client"))
+	request.NewAVP(avp.AcctInterimInterval, avp.Mbit, 0, datatype.Unsigned32(30))
+	return request
+}
+
+const test_rules = `
+rules:
+  - name: slow CCR
+    match:
+      command_code: 272
+      application_id: 4
+      avps:
+        - avp: Session-Id
+          regex: "^ccr_"
+    answer:
+      result_code: 2001
+      delay: 200ms
+      avps:
+        - avp: Origin-Host
+          value: test.server
+  - name: interval
+    match:
+      avps:
+        - avp: "85"
+          value: "30"
+        - avp: Origin-Host
+          value: other.client
+    answer:
+      result_code: 5012
+  - name: one-way messages
+    match:
+      avps:
+        - avp: Session-Id
+          value: test_send_message
+    answer:
+      no_answer: true
+  - name: requests
+    match:
+      avps:
+        - avp: Session-Id
+    answer:
+      result_code: 2001
+`
+
+func TestEvaluate(t *testing.T) {
+	rules, err := ParseRules([]byte(test_rules))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		request *diam.Message
+		rule    string // "": no rule
+	}{
+		{"CCR by command, application and regex", newTestRequest(diam.CreditControl, 4, "ccr_1"), "slow CCR"},
+		{"CCR of another application", newTestRequest(diam.CreditControl, 3, "ccr_1"), "requests"},
+		{"CCR not matching the regex", newTestRequest(diam.CreditControl, 4, "acr_1"), "requests"},
+		{"ACR matching the regex", newTestRequest(diam.Accounting, 4, "ccr_1"), "requests"},
+		{"one-way message", newTestRequest(diam.Accounting, 3, "test_send_message"), "one-way messages"},
+		{"literal value only", newTestRequest(diam.Accounting, 3, "test_send_message_2"), "requests"},
+		{"without Session-Id", newTestRequest(diam.Accounting, 3, ""), ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rule := rules.Evaluate(test.request)
+			switch {
+			case rule == nil && test.rule != "":
+				t.Errorf("no rule matched, want %q", test.rule)
+			case rule != nil && rule.Name != test.rule:
+				t.Errorf("rule %q matched, want %q", rule.Name, test.rule)
+			}
+		})
+	}
+}
+
+func TestEvaluateAVPCode(t *testing.T) {
+	rules, err := ParseRules([]byte(test_rules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := diam.NewRequest(diam.Accounting, 3, dict.Default)
+	request.NewAVP(avp.OriginHost, avp.Mbit, 0, datatype.DiameterIdentity("other.client"))
+	request.NewAVP(avp.AcctInterimInterval, avp.Mbit, 0, datatype.Unsigned32(30))
+	if rule := rules.Evaluate(request); rule == nil || rule.Name != "interval" {
+		t.Errorf("rule %v matched, want %q", rule, "interval")
+	}
+}
+
+func TestDefaultRules(t *testing.T) {
+	rules := defaultRules()
+	tests := []struct {
+		session_id string
+		no_answer  bool
+		result     uint32
+	}{
+		{"test_send_message", true, 0},
+		{"test_send_Multiple_message", true, 0},
+		{"test_send_request_1", false, 200},
+	}
+	for _, test := range tests {
+		rule := rules.Evaluate(newTestRequest(diam.Accounting, 3, test.session_id))
+		if rule == nil {
+			t.Errorf("%s: no rule matched", test.session_id)
+			continue
+		}
+		if rule.Answer.NoAnswer != test.no_answer || rule.Answer.ResultCode != test.result {
+			t.Errorf("%s: answer %+v, want no_answer %v result %d", test.session_id, rule.Answer, test.no_answer, test.result)
+		}
+	}
+}
+
+func TestBuild(t *testing.T) {
+	rules, err := ParseRules([]byte(test_rules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := newTestRequest(diam.CreditControl, 4, "ccr_1")
+	rule := rules.Evaluate(request)
+	if rule == nil {
+		t.Fatal("no rule matched")
+	}
+	if rule.Answer.Delay != 200*time.Millisecond {
+		t.Errorf("delay %s, want 200ms", rule.Answer.Delay)
+	}
+
+	answer, err := rule.Answer.Build(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answer.Header.CommandFlags&diam.RequestFlag != 0 {
+		t.Error("answer has the request flag")
+	}
+	if answer.Header.EndToEndID != request.Header.EndToEndID || answer.Header.HopByHopID != request.Header.HopByHopID {
+		t.Error("answer IDs differ from the request")
+	}
+	result_code, err := answer.FindAVP(avp.ResultCode, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result_code.Data.(datatype.Unsigned32) != 2001 {
+		t.Errorf("Result-Code %v, want 2001", result_code.Data)
+	}
+	origin_host, err := answer.FindAVP(avp.OriginHost, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if AVPValueString(origin_host.Data) != "test.server" {
+		t.Errorf("Origin-Host %v, want test.server", origin_host.Data)
+	}
+}
+
+func TestBuildInvalidValue(t *testing.T) {
+	answer := RuleAnswer{ResultCode: 2001, AVPs: []*AVPValue{{AVP: "Acct-Interim-Interval", Value: "soon"}}}
+	if _, err := answer.Build(newTestRequest(diam.Accounting, 3, "acr_1")); err == nil {
+		t.Error("answer built with an invalid Unsigned32 value")
+	}
+}
+
+func TestParseRulesErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules string
+		err   string
+	}{
+		{"no result code", "rules:\n  - name: zero\n    answer:\n      delay: 1s\n", "without result_code"},
+		{"zero result code", "rules:\n  - name: zero\n    answer:\n      result_code: 0\n", "without result_code"},
+		{"invalid regex", "rules:\n  - match:\n      avps:\n        - avp: Session-Id\n          regex: \"(\"\n    answer:\n      result_code: 2001\n", "rule_1"},
+		{"match without AVP", "rules:\n  - match:\n      avps:\n        - value: x\n    answer:\n      result_code: 2001\n", "without name or code"},
+		{"answer AVP without name", "rules:\n  - answer:\n      result_code: 2001\n      avps:\n        - value: x\n", "without name or code"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ParseRules([]byte(test.rules))
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("error %v, want %q", err, test.err)
+			}
+		})
+	}
+
+	if _, err := ParseRules([]byte("rules:\n  - answer:\n      no_answer: true\n")); err != nil {
+		t.Errorf("rule without answer: %v", err)
+	}
+}
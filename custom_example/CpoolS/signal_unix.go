@@ -0,0 +1,14 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// push_signals trigger the server-initiated requests, restart_signals the hot restart.
+var (
+	push_signals    = []os.Signal{syscall.SIGUSR1}
+	restart_signals = []os.Signal{syscall.SIGUSR2}
+)
@@ -0,0 +1,10 @@
+package main
+
+import "os"
+
+// There is no SIGUSR1/SIGUSR2 on Windows: the server-initiated requests are only sent every push-interval,
+// and there is no hot restart.
+var (
+	push_signals    []os.Signal
+	restart_signals []os.Signal
+)
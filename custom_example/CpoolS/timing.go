@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"time"
+
+	"common/vendordict"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+)
+
+// Timing AVPs: the answers carry the time the server received the request and sent the answer, in nanoseconds
+// since the Unix epoch, so the client splits its latency into network and server processing time.
+var timing_avps = flag.Bool("timing-avps", false, "Add the receive and send timestamps of the server to the answers (vendor 99999, AVP 1 and 2)")
+
+// WriteAnswer writes the answer to a request received at this time, with the Delivery-ID of the request
+// and the timing AVPs if enabled.
+func (c *serverConnection) WriteAnswer(request, answer *diam.Message, received time.Time) error {
+	if id, err := request.FindAVP(vendordict.DeliveryID, vendordict.VendorID); err == nil {
+		if _, err := answer.FindAVP(vendordict.DeliveryID, vendordict.VendorID); err != nil {
+			answer.AddAVP(id)
+		}
+	}
+	if *timing_avps {
+		answer.NewAVP(vendordict.ReceiveTimestamp, avp.Vbit, vendordict.VendorID, datatype.Unsigned64(received.UnixNano()))
+		answer.NewAVP(vendordict.SendTimestamp, avp.Vbit, vendordict.VendorID, datatype.Unsigned64(time.Now().UnixNano()))
+	}
+	return c.WriteMessage(answer)
+}
+
+// Acknowledge answers a one-way message carrying a Delivery-ID, it returns nil for the other messages
+// and if the answer could not be written.
+func (c *serverConnection) Acknowledge(request *diam.Message, received time.Time) *diam.Message {
+	if _, err := request.FindAVP(vendordict.DeliveryID, vendordict.VendorID); err != nil {
+		return nil
+	}
+	answer := request.Answer(diam.Success)
+	answer.NewAVP(avp.OriginHost, avp.Mbit, 0, origin_host)
+	answer.NewAVP(avp.OriginRealm, avp.Mbit, 0, origin_realm)
+	if err := c.WriteAnswer(request, answer, received); err != nil {
+		return nil
+	}
+	return answer
+}
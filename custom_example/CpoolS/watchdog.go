@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+	"github.com/fiorix/go-diameter/v4/diam/dict"
+)
+
+// Dead peer detection: without message from the client for idle-timeout, the server sends a Device-Watchdog-Request
+// and closes the connection if nothing is received in dwa-timeout. TCP keepalive detects the dead peers of the idle
+// connections too, its parameters are configurable.
+var (
+	idle_timeout       = flag.Duration("idle-timeout", 0, "Send a DWR to the client after this time without message (0: disabled)")
+	dwa_timeout        = flag.Duration("dwa-timeout", 5*time.Second, "Close the connection if the client sends no DWA in this time after the DWR")
+	keepalive_idle     = flag.Duration("tcp-keepalive-idle", 15*time.Second, "Idle time before the first TCP keepalive probe (negative: keepalive disabled)")
+	keepalive_interval = flag.Duration("tcp-keepalive-interval", 0, "Interval of the TCP keepalive probes (0: system default)")
+	keepalive_count    = flag.Int("tcp-keepalive-count", 0, "Number of unanswered TCP keepalive probes before the connection is closed (0: system default)")
+)
+
+// SetKeepAlive applies the TCP keepalive parameters to an accepted connection.
+func SetKeepAlive(client *net.TCPConn) error {
+	if *keepalive_idle < 0 {
+		return client.SetKeepAlive(false)
+	}
+	if err := client.SetKeepAlive(true); err != nil {
+		return err
+	}
+	if err := client.SetKeepAlivePeriod(*keepalive_idle); err != nil {
+		return err
+	}
+	if *keepalive_interval > 0 || *keepalive_count > 0 {
+		return setKeepAliveProbes(client, *keepalive_interval, *keepalive_count)
+	}
+	return nil
+}
+
+// byteCounter counts the bytes read from the connection, to know if a message was partially read at the deadline.
+type byteCounter struct {
+	io.Reader
+	n uint64
+}
+
+func (r *byteCounter) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	r.n += uint64(n)
+	return n, err
+}
+
+// ReadMessage reads the next message of the client, and sends the DWR when the connection is idle.
+// It returns an error if the client does not answer the DWR in time, or if the connection is idle for drain-idle
+// after the DPR of a hot restart.
+func (c *serverConnection) ReadMessage(reader io.Reader, counter *byteCounter) (*diam.Message, error) {
+	watchdog_sent := false
+	for {
+		draining := c.Draining()
+		if draining {
+			c.SetReadDeadline(time.Now().Add(*drain_idle))
+		} else if *idle_timeout > 0 {
+			timeout := *idle_timeout
+			if watchdog_sent {
+				timeout = *dwa_timeout
+			}
+			c.SetReadDeadline(time.Now().Add(timeout))
+			if c.Draining() {
+				// the deadline of DisconnectPeer was overwritten
+				continue
+			}
+		}
+
+		read := counter.n
+		message, err := diam.ReadMessage(reader, dict.Default)
+		if err == nil {
+			return message, nil
+		}
+		var net_err net.Error
+		if !errors.As(err, &net_err) || !net_err.Timeout() || counter.n != read {
+			// a message cut by the deadline can not be resumed
+			return nil, err
+		}
+		if draining {
+			return nil, fmt.Errorf("connection %s idle for %s after the DPR", c.RemoteAddr(), *drain_idle)
+		}
+		if c.Draining() {
+			// woken up by DisconnectPeer
+			continue
+		}
+		if watchdog_sent {
+			return nil, fmt.Errorf("dead peer %s, no DWA in %s", c.RemoteAddr(), *dwa_timeout)
+		}
+
+		if err := c.WriteMessage(c.WatchdogRequest()); err != nil {
+			return nil, err
+		}
+		watchdog_sent = true
+		mylog.Printf("Idle for %s, sent DWR to connectionID: %d\n", *idle_timeout, c.id)
+	}
+}
+
+func (c *serverConnection) WatchdogRequest() *diam.Message {
+	request := diam.NewRequest(diam.DeviceWatchdog, 0, nil)
+	request.NewAVP(avp.OriginHost, avp.Mbit, 0, origin_host)
+	request.NewAVP(avp.OriginRealm, avp.Mbit, 0, origin_realm)
+	return request
+}
+
+// resultCode returns the Result-Code of the answer, 0 without Result-Code.
+func resultCode(answer *diam.Message) uint32 {
+	if result_code, err := answer.FindAVP(avp.ResultCode, 0); err == nil {
+		if code, ok := result_code.Data.(datatype.Unsigned32); ok {
+			return uint32(code)
+		}
+	}
+	return 0
+}
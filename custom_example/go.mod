@@ -3,11 +3,16 @@ module test
 go 1.17
 
 require (
+	common v0.0.0
 	github.com/fiorix/go-diameter/v4 v4.0.4
 	github.com/tangnguyendeveloper/ConnectionPool v0.0.0-20230824001545-2876372b091f
+	golang.org/x/sys v0.13.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/ishidawataru/sctp v0.0.0-20190922091402-408ec287e38c // indirect
 	golang.org/x/net v0.0.0-20191007182048-72f939374954 // indirect
 )
+
+replace common => ../common
@@ -3,8 +3,10 @@ module test
 go 1.20
 
 require (
+	common v0.0.0
 	github.com/fiorix/go-diameter/v4 v4.0.4
 	github.com/jackc/puddle/v2 v2.2.1
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -12,3 +14,5 @@ require (
 	golang.org/x/net v0.0.0-20191007182048-72f939374954 // indirect
 	golang.org/x/sync v0.1.0 // indirect
 )
+
+replace common => ./common